@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/jsturma/ostack-misc/go/tools/ostack"
+)
+
+// addTargetFlags registers --backup-dir and --backup-target on fs.
+func addTargetFlags(fs *flag.FlagSet, cfg *ostack.Config) {
+	fs.StringVar(&cfg.BackupDir, "backup-dir", cfg.BackupDir, "Backup directory")
+	fs.StringVar(&cfg.BackupTarget, "backup-target", cfg.BackupTarget, "Backup target URL (file:///..., s3://..., swift://...); overrides --backup-dir")
+}
+
+// applyTargetFlags makes an explicit --backup-dir without --backup-target override
+// backup_target from the config file. Call after fs.Parse.
+func applyTargetFlags(fs *flag.FlagSet, cfg *ostack.Config) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if set["backup-dir"] && !set["backup-target"] {
+		cfg.BackupTarget = ""
+	}
+}
+
+// openTarget returns the sink for the configured backup target.
+func openTarget(ctx context.Context, fs *flag.FlagSet, cfg *ostack.Config) ostack.Sink {
+	applyTargetFlags(fs, cfg)
+	sink, err := ostack.NewSink(ctx, cfg, cfg.Target())
+	if err != nil {
+		log.Fatalf("Backup target: %v", err)
+	}
+	return sink
+}
+
+// commands maps subcommand names to their entry points. Anything else runs a backup.
+var commands = map[string]func(args []string){
+	"restore":        runRestore,
+	"restore-volume": runRestoreVolume,
+	"verify":         runVerify,
+	"prune":          runPrune,
+	"gc":             runGC,
+	"config":         runConfig,
+}
+
+func runRestore(args []string) {
+	cfg := loadConfig()
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	addAuthFlags(fs, cfg)
+	var from string
+	var opts ostack.RestoreOptions
+	fs.StringVar(&from, "from", "", "VM backup run (BACKUP_DIR/VM/TIMESTAMP path or backup target URL)")
+	fs.StringVar(&opts.Name, "name", "", "Name of the restored server (default: recorded name)")
+	fs.StringVar(&opts.Flavor, "flavor", "", "Flavor ID (default: recorded flavor)")
+	fs.StringVar(&opts.BootVolume, "boot-volume", "", "Original volume ID of the boot disk (default: first recorded attachment)")
+	fs.BoolVar(&opts.FromSnapshot, "from-snapshot", false, "Create volumes from the snapshots kept in the cloud (snapshot_retention) instead of the backup files")
+	fs.Func("network", "Network ID to attach (repeatable; default: recorded network names)", func(s string) error {
+		opts.Networks = append(opts.Networks, strings.Split(s, ",")...)
+		return nil
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: protect-ostack restore --from BACKUP_DIR/VM/TIMESTAMP [--from-snapshot] [OPTIONS]\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if from == "" {
+		log.Fatal("Missing required: --from")
+	}
+	requireAuth(cfg)
+	ctx := context.Background()
+	provider := authenticate(ctx, cfg)
+	id, err := ostack.RestoreVM(ctx, provider, cfg, from, opts)
+	if err != nil {
+		log.Fatalf("Restore failed: %v", err)
+	}
+	log.Printf("=== RESTORE COMPLETED: server %s ===", id)
+}
+
+func runRestoreVolume(args []string) {
+	cfg := loadConfig()
+	fs := flag.NewFlagSet("restore-volume", flag.ExitOnError)
+	addAuthFlags(fs, cfg)
+	var file, name, attachTo string
+	var fromSnapshot bool
+	fs.StringVar(&file, "file", "", "Volume backup file (<volID>.<format> path or backup target URL)")
+	fs.StringVar(&name, "name", "", "Name of the restored volume (default: restored-<volID>)")
+	fs.StringVar(&attachTo, "attach-to", "", "Server name or ID to attach the restored volume to")
+	fs.BoolVar(&fromSnapshot, "from-snapshot", false, "Create the volume from the snapshot kept in the cloud (snapshot_retention) instead of the backup file")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: protect-ostack restore-volume --file VOLID.FORMAT [--name NAME] [--attach-to SERVER] [--from-snapshot] [OPTIONS]\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if file == "" {
+		log.Fatal("Missing required: --file")
+	}
+	requireAuth(cfg)
+	ctx := context.Background()
+	provider := authenticate(ctx, cfg)
+	id, err := ostack.RestoreVolume(ctx, provider, cfg, file, name, attachTo, fromSnapshot)
+	if err != nil {
+		log.Fatalf("Volume restore failed: %v", err)
+	}
+	log.Printf("=== VOLUME RESTORE COMPLETED: volume %s ===", id)
+}
+
+func runVerify(args []string) {
+	cfg := loadConfig()
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var configFilePath, since string
+	var opts ostack.VerifyOptions
+	fs.StringVar(&configFilePath, "config", configPathFromArgs(), "Path to config file (YAML)")
+	addTargetFlags(fs, cfg)
+	fs.StringVar(&opts.VM, "vm", "", "Only verify backups of this VM")
+	fs.StringVar(&since, "since", "", "Only verify backups taken on or after DATE (YYYY-MM-DD)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: protect-ostack verify [--backup-dir DIR | --backup-target URL] [--vm NAME] [--since DATE]\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if since != "" {
+		t, err := time.ParseInLocation("2006-01-02", since, time.Local)
+		if err != nil {
+			log.Fatalf("Invalid --since %q (want YYYY-MM-DD): %v", since, err)
+		}
+		opts.Since = t
+	}
+	ctx := context.Background()
+	sink := openTarget(ctx, fs, cfg)
+	chunks, err := ostack.NewChunkStore(ctx, cfg, sink)
+	if err != nil {
+		log.Fatalf("Backup target: %v", err)
+	}
+	opts.Chunks = chunks
+	report, err := ostack.Verify(ctx, sink, opts)
+	if err != nil {
+		log.Fatalf("Verify failed: %v", err)
+	}
+	log.Printf("Verified %d file(s) in %d backup(s) under %s", report.Files, report.Backups, sink)
+	if !report.OK() {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found:\n", len(report.Problems))
+		for _, p := range report.Problems {
+			fmt.Fprintf(os.Stderr, "  %s\n", p)
+		}
+		os.Exit(1)
+	}
+	log.Println("=== ALL BACKUPS VERIFIED ===")
+}
+
+func runPrune(args []string) {
+	cfg := loadConfig()
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	addAuthFlags(fs, cfg)
+	var vm string
+	var dryRun bool
+	addTargetFlags(fs, cfg)
+	fs.StringVar(&vm, "vm", "", "Only prune backups of this VM")
+	fs.BoolVar(&dryRun, "dry-run", false, "List backups that would be removed without removing them")
+	fs.IntVar(&cfg.KeepLast, "keep-last", cfg.KeepLast, "Keep the N most recent backups")
+	fs.IntVar(&cfg.KeepDaily, "keep-daily", cfg.KeepDaily, "Keep the newest backup of each of the last N days")
+	fs.IntVar(&cfg.KeepWeekly, "keep-weekly", cfg.KeepWeekly, "Keep the newest backup of each of the last N weeks")
+	fs.IntVar(&cfg.KeepMonthly, "keep-monthly", cfg.KeepMonthly, "Keep the newest backup of each of the last N months")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: protect-ostack prune [--backup-dir DIR | --backup-target URL] [--vm NAME] [--dry-run] [--keep-last N] [--keep-daily N] [--keep-weekly N] [--keep-monthly N] [OPTIONS]\n\nRuns holding Cinder backups are removed only with OpenStack credentials, which delete the backups too.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	ctx := context.Background()
+	// Credentials are only needed to delete the Cinder backups of removed runs.
+	var provider *gophercloud.ProviderClient
+	warnSecretArgs()
+	if err := ostack.ValidateAuth(cfg); err == nil {
+		provider = authenticate(ctx, cfg)
+	} else {
+		log.Println("No OpenStack credentials; runs holding Cinder backups will be kept")
+	}
+	res, err := ostack.Prune(ctx, provider, openTarget(ctx, fs, cfg), cfg, vm, dryRun)
+	if err != nil {
+		log.Fatalf("Prune failed: %v", err)
+	}
+	if dryRun {
+		log.Printf("=== DRY RUN: would remove %d backup(s), keep %d ===", len(res.Removed), len(res.Kept))
+		return
+	}
+	log.Printf("=== PRUNE COMPLETED: removed %d backup(s), kept %d ===", len(res.Removed), len(res.Kept))
+}
+
+func runGC(args []string) {
+	cfg := loadConfig()
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	var configFilePath string
+	var dryRun bool
+	fs.StringVar(&configFilePath, "config", configPathFromArgs(), "Path to config file (YAML)")
+	addTargetFlags(fs, cfg)
+	fs.StringVar(&cfg.ChunkStore, "chunk-store", cfg.ChunkStore, "Chunk store location (default: BACKUP_TARGET/_chunks)")
+	fs.BoolVar(&dryRun, "dry-run", false, "Count unreferenced chunks without removing them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: protect-ostack gc [--backup-dir DIR | --backup-target URL] [--chunk-store URL] [--dry-run]\n\n")
+		fmt.Fprintf(os.Stderr, "Removes dedup chunks no longer referenced by any backup (run after prune, not during a backup).\nWith chunk_store, the indexes of every backup target that stored chunks in it are read too.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	ctx := context.Background()
+	sink := openTarget(ctx, fs, cfg)
+	chunks, err := ostack.NewChunkStore(ctx, cfg, sink)
+	if err != nil {
+		log.Fatalf("Backup target: %v", err)
+	}
+	roots := []ostack.Sink{sink}
+	if cfg.ChunkStore != "" {
+		targets, err := ostack.TargetConfigs(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		roots, err = ostack.ChunkStoreRoots(ctx, append([]*ostack.Config{cfg}, targets...), chunks, sink)
+		if err != nil {
+			log.Fatalf("GC failed: %v", err)
+		}
+	}
+	res, err := ostack.GC(ctx, roots, chunks, dryRun)
+	if err != nil {
+		log.Fatalf("GC failed: %v", err)
+	}
+	if dryRun {
+		log.Printf("=== DRY RUN: would remove %d chunk(s) (%d bytes) ===", res.Removed, res.RemovedBytes)
+		return
+	}
+	log.Printf("=== GC COMPLETED: removed %d chunk(s) (%d bytes), %d referenced ===", res.Removed, res.RemovedBytes, res.Referenced)
+}
+
+// runConfig prints the effective configuration (config file, clouds.yaml, OS_* variables, and
+// flags) with secrets redacted.
+func runConfig(args []string) {
+	cfg := loadConfig()
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	addAuthFlags(fs, cfg)
+	addTargetFlags(fs, cfg)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: protect-ostack config [--config PATH] [--os-cloud NAME] [OPTIONS]\n\nPrints the effective configuration with secrets redacted (one document per target).\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	applyTargetFlags(fs, cfg)
+	if len(cfg.Targets) == 0 {
+		fmt.Print(cfg)
+		return
+	}
+	targets, err := ostack.TargetConfigs(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, t := range targets {
+		if i > 0 {
+			fmt.Println("---")
+		}
+		fmt.Printf("# target: %s\n%s", t.TargetName(), t)
+	}
+}
@@ -7,24 +7,52 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strings"
 
+	"github.com/gophercloud/gophercloud/v2"
 	"github.com/jsturma/ostack-misc/go/tools/ostack"
 )
 
 func usage() {
 	fmt.Fprintf(os.Stderr, `Usage: protect-ostack [OPTIONS]
+       protect-ostack restore --from BACKUP_DIR/VM/TIMESTAMP [--from-snapshot] [OPTIONS]
+       protect-ostack restore-volume --file VOLID.FORMAT [--name NAME] [--attach-to SERVER] [--from-snapshot] [OPTIONS]
+       protect-ostack verify [--backup-dir DIR | --backup-target URL] [--vm NAME] [--since DATE]
+       protect-ostack prune [--backup-dir DIR | --backup-target URL] [--vm NAME] [--dry-run] [--keep-last N] [--keep-daily N] [--keep-weekly N] [--keep-monthly N]
+       protect-ostack gc [--backup-dir DIR | --backup-target URL] [--chunk-store URL] [--dry-run]
+       protect-ostack config [--config PATH] [--os-cloud NAME] [OPTIONS]
 
-Config: defaults from cfg/config.yaml (or --config PATH). CLI overrides config file.
+Config: defaults from cfg/config.yaml (or --config PATH), overridden in turn by the clouds.yaml
+cloud named by --os-cloud (or OS_CLOUD), the OS_* environment variables, and CLI flags.
+With targets in the config file, each target (cloud/region) is backed up in turn into
+BACKUP_DIR/NAME (or BACKUP_TARGET/NAME), with the target's cloud and keys applied last.
 
-Required (in config or CLI): --keystone-url URL --project NAME --user NAME --password PASSWORD
-Optional: [--config PATH] [--region NAME] [--domain NAME] [--backup-dir DIR] [--disk-format FORMAT]
+Required (in config or CLI): --keystone-url URL --project NAME --user NAME --password-file FILE (or --password-env VAR, --password PASSWORD)
+  or, with --auth-type application_credential: --application-credential-id ID --application-credential-secret SECRET
+Optional: [--config PATH] [--os-cloud NAME] [--region NAME] [--interface public|internal|admin]
+         [--ca-file PEM] [--cert-file PEM --key-file PEM] [--insecure]
+         [--domain NAME] [--user-domain NAME] [--project-domain NAME] [--project-id ID]
+         [--backup-dir DIR] [--backup-target URL] [--disk-format FORMAT]
          [--max-parallel-snap N] [--max-parallel-vol N] [--discover-all] [--vm-filter PATTERN] [--vm-tags KEY:VALUE] [--vm-list VM1 VM2 ...]
+         [--discover-volumes attached|all|unattached] [--volume-filter PATTERN]
+         [--projects "PROJECT1 PROJECT2 ..." | --projects "*"] [--project-role ROLE]
+         [--backup-method glance-export|cinder-backup] [--prune] [--dedup]
          [--help]
 
 Examples:
-  protect-ostack --keystone-url https://keystone.example.com:5000/v3 --project myproject --user myuser --password mypass
+  protect-ostack --keystone-url https://keystone.example.com:5000/v3 --project myproject --user myuser --password-file /etc/protect-ostack/password
   protect-ostack --config cfg/config.yaml
+  protect-ostack --os-cloud mycloud
+  protect-ostack --projects "*" --project-role backup
+  protect-ostack verify --vm vm1 --since 2026-01-01
+  protect-ostack verify --vm _volumes/data-archive-3f2a9c1e
+  protect-ostack prune --keep-daily 7 --keep-weekly 4 --dry-run
+  protect-ostack gc --dry-run
+  protect-ostack restore --from /backup/openstack/vm1/2026-01-27_14-30
+  protect-ostack restore-volume --file /backup/openstack/vm1/2026-01-27_14-30/VOLID.qcow2 --name data --attach-to vm1
+
+Run 'protect-ostack COMMAND --help' for command options.
 `)
 	os.Exit(0)
 }
@@ -38,62 +66,201 @@ func configPathFromArgs() string {
 	return ostack.DefaultConfigPath
 }
 
-func parseFlags() *ostack.Config {
+// cloudFromArgs returns the --os-cloud value from os.Args, else OS_CLOUD.
+func cloudFromArgs() string {
+	for i, a := range os.Args {
+		if (a == "--os-cloud" || a == "-os-cloud") && i+1 < len(os.Args) {
+			return os.Args[i+1]
+		}
+		if v, ok := strings.CutPrefix(a, "--os-cloud="); ok {
+			return v
+		}
+	}
+	return os.Getenv("OS_CLOUD")
+}
+
+// loadConfig loads the config file named by --config (or the default path), then applies the
+// clouds.yaml cloud named by --os-cloud (or OS_CLOUD) and the OS_* environment variables.
+// CLI flags, registered with these values as defaults, override all of them.
+func loadConfig() *ostack.Config {
 	configPath := configPathFromArgs()
 	cfg, err := ostack.LoadConfig(configPath)
 	if err != nil {
 		log.Fatalf("Load config %s: %v", configPath, err)
 	}
+	if cloud := cloudFromArgs(); cloud != "" {
+		if err := ostack.ApplyCloud(cfg, cloud); err != nil {
+			log.Fatalf("Load clouds.yaml: %v", err)
+		}
+	}
+	ostack.ApplyEnv(cfg)
+	return cfg
+}
 
+// addAuthFlags registers --config and the Keystone auth flags on fs; values default to cfg.
+func addAuthFlags(fs *flag.FlagSet, cfg *ostack.Config) {
 	var configFilePath string
-	flag.StringVar(&configFilePath, "config", configPath, "Path to config file (YAML)")
-	flag.StringVar(&cfg.KeystoneURL, "keystone-url", cfg.KeystoneURL, "Keystone endpoint (e.g. https://keystone.example.com:5000/v3)")
-	flag.StringVar(&cfg.Project, "project", cfg.Project, "OpenStack project")
-	flag.StringVar(&cfg.User, "user", cfg.User, "OpenStack user")
-	flag.StringVar(&cfg.Password, "password", cfg.Password, "OpenStack password")
-	flag.StringVar(&cfg.Domain, "domain", cfg.Domain, "Domain")
-	flag.StringVar(&cfg.Region, "region", cfg.Region, "OpenStack region for service discovery")
-	flag.StringVar(&cfg.BackupDir, "backup-dir", cfg.BackupDir, "Backup directory")
+	fs.StringVar(&configFilePath, "config", configPathFromArgs(), "Path to config file (YAML)")
+	var cloud string
+	fs.StringVar(&cloud, "os-cloud", cloudFromArgs(), "Cloud from clouds.yaml (default: $OS_CLOUD)")
+	fs.StringVar(&cfg.KeystoneURL, "keystone-url", cfg.KeystoneURL, "Keystone endpoint (e.g. https://keystone.example.com:5000/v3)")
+	fs.StringVar(&cfg.AuthType, "auth-type", cfg.AuthType, "Keystone auth: password, application_credential, token")
+	fs.StringVar(&cfg.Project, "project", cfg.Project, "OpenStack project")
+	fs.StringVar(&cfg.ProjectID, "project-id", cfg.ProjectID, "OpenStack project ID (instead of --project)")
+	fs.StringVar(&cfg.User, "user", cfg.User, "OpenStack user")
+	fs.StringVar(&cfg.Password, "password", cfg.Password, "OpenStack password (visible in ps; prefer --password-file)")
+	fs.StringVar(&cfg.PasswordFile, "password-file", cfg.PasswordFile, "File holding the OpenStack password")
+	fs.StringVar(&cfg.PasswordEnv, "password-env", cfg.PasswordEnv, "Environment variable holding the OpenStack password")
+	fs.StringVar(&cfg.Domain, "domain", cfg.Domain, "Domain")
+	fs.StringVar(&cfg.UserDomain, "user-domain", cfg.UserDomain, "User domain (default: --domain)")
+	fs.StringVar(&cfg.ProjectDomain, "project-domain", cfg.ProjectDomain, "Project domain (default: --domain)")
+	fs.StringVar(&cfg.ApplicationCredentialID, "application-credential-id", cfg.ApplicationCredentialID, "Application credential ID")
+	fs.StringVar(&cfg.ApplicationCredentialSecret, "application-credential-secret", cfg.ApplicationCredentialSecret, "Application credential secret")
+	fs.StringVar(&cfg.Region, "region", cfg.Region, "OpenStack region for service discovery")
+	fs.StringVar(&cfg.Interface, "interface", cfg.Interface, "Catalog endpoint interface: public, internal, admin")
+	fs.StringVar(&cfg.TLS.CAFile, "ca-file", cfg.TLS.CAFile, "PEM CA bundle to trust in addition to the system roots")
+	fs.StringVar(&cfg.TLS.CertFile, "cert-file", cfg.TLS.CertFile, "PEM TLS client certificate")
+	fs.StringVar(&cfg.TLS.KeyFile, "key-file", cfg.TLS.KeyFile, "PEM TLS client key")
+	fs.BoolVar(&cfg.TLS.InsecureSkipVerify, "insecure", cfg.TLS.InsecureSkipVerify, "Skip TLS certificate verification (lab clouds only)")
+}
+
+// secretFlags are the flags whose values other users can read in the process list.
+var secretFlags = []string{"password", "application-credential-secret"}
+
+// warnSecretArgs warns about secrets given on the command line.
+func warnSecretArgs() {
+	for _, a := range os.Args[1:] {
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		name, _, _ := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		if slices.Contains(secretFlags, name) {
+			log.Printf("Warning: --%s is visible to other users in the process list; use password_file, password_env, password_command, or OS_* variables instead", name)
+		}
+	}
+}
+
+// requireAuth exits if the Keystone credentials are incomplete.
+func requireAuth(cfg *ostack.Config) {
+	warnSecretArgs()
+	if err := ostack.ValidateAuth(cfg); err != nil {
+		log.Fatalf("%v (set in cfg/config.yaml, clouds.yaml, OS_* variables, or via CLI)", err)
+	}
+}
+
+// authenticate builds the Gophercloud provider or exits.
+func authenticate(ctx context.Context, cfg *ostack.Config) *gophercloud.ProviderClient {
+	provider, err := ostack.NewProvider(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Auth failed: %v", err)
+	}
+	log.Println("Authenticated with OpenStack (Gophercloud)")
+	return provider
+}
+
+// validateConfig checks the backup settings of cfg (or of one target).
+func validateConfig(cfg *ostack.Config) error {
+	if !ostack.SupportedDiskFormats[cfg.DiskFormat] {
+		return fmt.Errorf("invalid disk format: %s (supported: qcow2, raw, vmdk, vdi)", cfg.DiskFormat)
+	}
+	if err := ostack.ValidateBackupMethod(cfg); err != nil {
+		return err
+	}
+	if err := ostack.ValidateHooks(cfg); err != nil {
+		return err
+	}
+	if err := ostack.ValidateVolumeDiscovery(cfg); err != nil {
+		return err
+	}
+	return ostack.ValidateProjects(cfg)
+}
+
+// loadTargets returns the configs of cfg.Targets, validated, or exits.
+func loadTargets(cfg *ostack.Config) []*ostack.Config {
+	targets, err := ostack.TargetConfigs(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, t := range targets {
+		if err := ostack.ValidateAuth(t); err != nil {
+			log.Fatalf("target %s: %v (set in the target, cfg/config.yaml, clouds.yaml, OS_* variables, or via CLI)", t.TargetName(), err)
+		}
+		if err := validateConfig(t); err != nil {
+			log.Fatalf("target %s: %v", t.TargetName(), err)
+		}
+	}
+	return targets
+}
+
+// parseFlags returns the configuration and, if it lists targets, the config of each target.
+func parseFlags() (*ostack.Config, []*ostack.Config) {
+	cfg := loadConfig()
+	addAuthFlags(flag.CommandLine, cfg)
+	addTargetFlags(flag.CommandLine, cfg)
 	flag.StringVar(&cfg.DiskFormat, "disk-format", cfg.DiskFormat, "Disk format: qcow2, raw, vmdk, vdi")
+	flag.StringVar(&cfg.BackupMethod, "backup-method", cfg.BackupMethod, "Volume backup method: glance-export, cinder-backup")
 	flag.IntVar(&cfg.MaxParallelSnapShots, "max-parallel-snap", cfg.MaxParallelSnapShots, "Max concurrent VM backup tasks (snapshots); 0 = unlimited")
 	flag.IntVar(&cfg.MaxParallelVolumes, "max-parallel-vol", cfg.MaxParallelVolumes, "Max concurrent volume backups across all VMs; 0 = unlimited")
 	flag.BoolVar(&cfg.DiscoverAll, "discover-all", cfg.DiscoverAll, "Discover all VMs")
 	flag.BoolFunc("no-discover-all", "Use manual VM list", func(s string) error { cfg.DiscoverAll = false; return nil })
+	flag.BoolVar(&cfg.PruneAfterRun, "prune", cfg.PruneAfterRun, "Apply the retention policy to the backed-up VMs after a successful run")
+	flag.BoolVar(&cfg.Dedup, "dedup", cfg.Dedup, "Store volume images as deduplicated chunks in the chunk store")
 	flag.StringVar(&cfg.VMFilter, "vm-filter", cfg.VMFilter, "Filter VMs by name (e.g. prod-*)")
+	flag.StringVar(&cfg.DiscoverVolumes, "discover-volumes", cfg.DiscoverVolumes, "Volumes to back up: attached (VMs' volumes), all (also unattached volumes), unattached (only unattached volumes)")
+	flag.StringVar(&cfg.VolumeFilter, "volume-filter", cfg.VolumeFilter, "Filter unattached volumes by name (e.g. data-*)")
 	flag.StringVar(&cfg.VMTags, "vm-tags", cfg.VMTags, "Filter by tags/metadata (e.g. backup:true)")
 	flag.Func("vm-list", "Manual VM list (space-separated)", func(s string) error {
 		cfg.VMList = strings.Fields(s)
 		cfg.DiscoverAll = false
 		return nil
 	})
+	flag.Func("projects", "Projects to back up, each under BACKUP_DIR/PROJECT (space-separated names or IDs; \"*\" = all accessible)", func(s string) error {
+		cfg.Projects = strings.Fields(s)
+		return nil
+	})
+	flag.StringVar(&cfg.ProjectRole, "project-role", cfg.ProjectRole, "With --projects, skip projects where the user lacks this role")
 	flag.Usage = usage
 	flag.Parse()
+	applyTargetFlags(flag.CommandLine, cfg)
 
-	if cfg.KeystoneURL == "" || cfg.Project == "" || cfg.User == "" || cfg.Password == "" {
-		log.Fatal("Missing required: keystone_url, project, user, password (set in cfg/config.yaml or via CLI)")
+	if len(cfg.Targets) > 0 {
+		warnSecretArgs()
+		return cfg, loadTargets(cfg)
 	}
-	if !ostack.SupportedDiskFormats[cfg.DiskFormat] {
-		log.Fatalf("Invalid disk format: %s (supported: qcow2, raw, vmdk, vdi)", cfg.DiskFormat)
+	requireAuth(cfg)
+	if err := validateConfig(cfg); err != nil {
+		log.Fatal(err)
 	}
-	return cfg
+	return cfg, nil
 }
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime)
-	cfg := parseFlags()
-	if err := os.MkdirAll(cfg.BackupDir, 0755); err != nil {
-		log.Fatalf("Cannot create backup dir: %v", err)
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
 	}
-	log.Printf("Starting backup - Keystone: %s, Project: %s, Region: %s, Dir: %s",
-		cfg.KeystoneURL, cfg.Project, cfg.Region, cfg.BackupDir)
-
+	cfg, targets := parseFlags()
 	ctx := context.Background()
-	provider, err := ostack.NewProvider(ctx, cfg)
-	if err != nil {
-		log.Fatalf("Auth failed: %v", err)
+	if len(targets) > 0 {
+		log.Printf("Starting backup of %d targets", len(targets))
+		if err := ostack.RunTargets(ctx, targets); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("=== ALL BACKUPS COMPLETED ===")
+		return
 	}
-	log.Println("Authenticated with OpenStack (Gophercloud)")
+	if cfg.BackupTarget == "" {
+		if err := os.MkdirAll(cfg.BackupDir, 0755); err != nil {
+			log.Fatalf("Cannot create backup dir: %v", err)
+		}
+	}
+	log.Printf("Starting backup - Keystone: %s, Project: %s, Region: %s, Target: %s",
+		cfg.KeystoneURL, cfg.Project, cfg.Region, cfg.Target())
 
+	provider := authenticate(ctx, cfg)
 	if err := ostack.Run(ctx, provider, cfg); err != nil {
 		log.Fatal(err)
 	}
@@ -8,9 +8,13 @@ import (
 	"time"
 )
 
-// NewClient returns an HTTP client with a 60s timeout for API calls.
-func NewClient() *http.Client {
-	return &http.Client{Timeout: 60 * time.Second}
+// NewClient returns an HTTP client with a 60s timeout for API calls, using the TLS settings of cfg.
+func NewClient(cfg *Config) (*http.Client, error) {
+	tr, err := cfg.TLS.Transport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Timeout: 60 * time.Second, Transport: tr}, nil
 }
 
 func apiCall(client *http.Client, method, url, token string, body []byte) ([]byte, error) {
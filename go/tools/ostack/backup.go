@@ -2,66 +2,93 @@ package ostack
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"path/filepath"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/gophercloud/gophercloud/v2"
 	"github.com/gophercloud/gophercloud/v2/openstack"
 	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/snapshots"
 	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
 	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/imagedata"
 	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
 	"golang.org/x/sync/errgroup"
 )
 
-// BackupVolume creates a snapshot, temp volume, uploads to Glance, downloads the image file, then cleans up.
-func BackupVolume(ctx context.Context, blockClient *gophercloud.ServiceClient, imageClient *gophercloud.ServiceClient, cfg *Config, volID, backupDir string) error {
+// BackupVolume creates a snapshot, temp volume, uploads to Glance, downloads the image into dest
+// (or, with a chunk store, into chunks plus an index in dest), then cleans up.
+// With snapshot_retention, the snapshot of a successful backup is kept, tagged with runID, and the
+// volume's older kept snapshots are pruned. If snap is set, that snapshot is used instead of a new one;
+// a group snapshot member is left to its owner. Returns the manifest entry for the downloaded file.
+func BackupVolume(ctx context.Context, blockClient *gophercloud.ServiceClient, imageClient *gophercloud.ServiceClient, cfg *Config, att VolumeAttachment, dest Sink, chunks *ChunkStore, runID string, snap *takenSnapshot) (*Artifact, error) {
+	volID := att.VolumeID
+	prov := &VolumeProvenance{VolumeID: volID, Device: att.Device, DiskFormat: cfg.DiskFormat, StartedAt: time.Now().UTC()}
 	timestamp := time.Now().Format("2006-01-02_1504")
 	log.Printf("Backing up volume %s", volID)
 
-	// Create snapshot
-	snap, err := snapshots.Create(ctx, blockClient, snapshots.CreateOpts{
-		VolumeID: volID,
-		Name:     "snap-" + volID + "-" + timestamp,
-		Force:    true,
-	}).Extract()
-	if err != nil {
-		return err
-	}
-	snapID := snap.ID
-	defer func() {
-		if err := snapshots.Delete(ctx, blockClient, snapID).ExtractErr(); err != nil {
-			log.Printf("Warning: Failed to delete snapshot %s: %v", snapID, err)
+	keepSnap := cfg.SnapshotRetention > 0 && snap.owned()
+	var snapID string
+	if snap == nil {
+		// Create snapshot
+		s, err := snapshots.Create(ctx, blockClient, backupSnapshotOpts(volID, runID, keepSnap)).Extract()
+		if err != nil {
+			return nil, err
+		}
+		snapID = s.ID
+	} else {
+		snap.used = true
+		snapID = snap.ID
+		prov.GroupSnapshotID = snap.GroupSnapshotID
+		if snap.GroupSnapshotID != "" {
+			log.Printf("Using group snapshot member %s", snapID)
 		} else {
-			log.Printf("Cleaned up snapshot: %s", snapID)
+			log.Printf("Using snapshot %s", snapID)
 		}
-	}()
+	}
+	if snap.owned() {
+		defer func() {
+			if prov.SnapshotKept {
+				log.Printf("Keeping snapshot %s of volume %s", snapID, volID)
+				return
+			}
+			if err := snapshots.Delete(ctx, blockClient, snapID).ExtractErr(); err != nil {
+				log.Printf("Warning: Failed to delete snapshot %s: %v", snapID, err)
+			} else {
+				log.Printf("Cleaned up snapshot: %s", snapID)
+			}
+		}()
+	}
+	prov.SnapshotID = snapID
 
-	err = snapshots.WaitForStatus(ctx, blockClient, snapID, "available")
+	err := snapshots.WaitForStatus(ctx, blockClient, snapID, "available")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	vol, err := volumes.Get(ctx, blockClient, volID).Extract()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	volSize := vol.Size
+	prov.SizeGB = volSize
 	log.Printf("Creating temp volume (%dGB)", volSize)
 
 	tmpVol, err := volumes.Create(ctx, blockClient, volumes.CreateOpts{
 		SnapshotID: snapID,
 		Size:       volSize,
 		Name:       "tmp-" + volID + "-" + timestamp,
+		Metadata:   map[string]string{TempVolumeMetaKey: "true"},
 	}, nil).Extract()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	tmpVolID := tmpVol.ID
+	prov.TempVolumeID = tmpVolID
 	defer func() {
 		if err := volumes.Delete(ctx, blockClient, tmpVolID, volumes.DeleteOpts{}).ExtractErr(); err != nil {
 			log.Printf("Warning: Failed to delete volume %s: %v", tmpVolID, err)
@@ -72,7 +99,7 @@ func BackupVolume(ctx context.Context, blockClient *gophercloud.ServiceClient, i
 
 	err = volumes.WaitForStatus(ctx, blockClient, tmpVolID, "available")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	log.Printf("Creating image (%s format)", cfg.DiskFormat)
@@ -82,9 +109,10 @@ func BackupVolume(ctx context.Context, blockClient *gophercloud.ServiceClient, i
 		ContainerFormat: "bare",
 	}).Extract()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	imgID := imgResult.ImageID
+	prov.ImageID = imgID
 	defer func() {
 		if err := images.Delete(ctx, imageClient, imgID).ExtractErr(); err != nil {
 			log.Printf("Warning: Failed to delete image %s: %v", imgID, err)
@@ -93,69 +121,242 @@ func BackupVolume(ctx context.Context, blockClient *gophercloud.ServiceClient, i
 		}
 	}()
 
-	// Wait for image to become active (timeout/interval from config)
+	if err := waitImageActive(ctx, imageClient, cfg, imgID); err != nil {
+		return nil, err
+	}
+
+	art, err := downloadImage(ctx, imageClient, cfg, imgID, dest, chunks, volID+"."+cfg.DiskFormat)
+	if err != nil {
+		return nil, err
+	}
+	art.Kind = ArtifactVolume
+	art.Volume = prov
+	log.Printf("Volume %s backed up", volID)
+	prov.FinishedAt = time.Now().UTC()
+	if keepSnap {
+		prov.SnapshotKept = true
+		pruneVolumeSnapshots(ctx, blockClient, volID, cfg.SnapshotRetention)
+	}
+	return art, nil
+}
+
+// downloadImage streams a Glance image into dest under name (plus the compression suffix, if any),
+// compressing and hashing it on the way, writes its checksum sidecar, and returns its manifest entry.
+// With a chunk store, the image is stored as chunks and dest gets name.chunks instead.
+func downloadImage(ctx context.Context, imageClient *gophercloud.ServiceClient, cfg *Config, imgID string, dest Sink, chunks *ChunkStore, name string) (*Artifact, error) {
+	ensureToken(ctx, imageClient)
+	res := imagedata.Download(ctx, imageClient, imgID)
+	rc, err := res.Extract()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if chunks != nil {
+		log.Printf("Downloading image %s to chunk store %s", imgID, chunks)
+		return storeChunked(ctx, cfg, chunks, rc, dest, name, strings.TrimPrefix(path.Ext(name), "."))
+	}
+	codec := compressionCodec(cfg)
+	name += compressionSuffixes[codec]
+	log.Printf("Downloading image %s to %s/%s", imgID, dest, name)
+	w, err := dest.Create(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	hw := newHashingWriter()
+	var out io.Writer = io.MultiWriter(w, hw)
+	var zw io.WriteCloser
+	if codec != "" {
+		zw, err = newCompressWriter(out, cfg)
+		if err != nil {
+			w.Abort()
+			return nil, err
+		}
+		out = zw
+	}
+	n, err := io.Copy(out, rc)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if n == 0 {
+		w.Abort()
+		return nil, fmt.Errorf("downloaded file is empty")
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	art := &Artifact{
+		File:      name,
+		SHA256:    hw.Sum(),
+		SizeBytes: hw.n,
+	}
+	if codec != "" {
+		art.Compression = codec
+		art.UncompressedBytes = n
+		log.Printf("Downloaded %s/%s (%d bytes, %s %.1f%%)", dest, name, n, codec, 100*float64(hw.n)/float64(n))
+	} else {
+		log.Printf("Downloaded %s/%s", dest, name)
+	}
+	if err := writeChecksumSidecar(ctx, dest, art.File, art.SHA256); err != nil {
+		return nil, fmt.Errorf("write checksum: %w", err)
+	}
+	return art, nil
+}
+
+// waitImageActive polls Glance until the image is active, using the status timeout/interval from config.
+func waitImageActive(ctx context.Context, imageClient *gophercloud.ServiceClient, cfg *Config, imgID string) error {
 	timeout := time.Duration(cfg.StatusTimeoutSec) * time.Second
 	interval := time.Duration(cfg.StatusIntervalSec) * time.Second
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
+		ensureToken(ctx, imageClient)
 		img, err := images.Get(ctx, imageClient, imgID).Extract()
 		if err != nil {
 			return err
 		}
 		if img.Status == "active" {
 			log.Printf("Image %s is active", imgID)
-			break
+			return nil
 		}
 		if img.Status == "error" || img.Status == "killed" {
 			return fmt.Errorf("image %s entered %s state", imgID, img.Status)
 		}
 		time.Sleep(interval)
 	}
+	return fmt.Errorf("timeout waiting for image %s", imgID)
+}
 
-	outPath := filepath.Join(backupDir, volID+"."+cfg.DiskFormat)
-	log.Printf("Downloading %s to %s", cfg.DiskFormat, outPath)
-	res := imagedata.Download(ctx, imageClient, imgID)
-	rc, err := res.Extract()
+// newServiceClients returns the Compute, Block Storage, and Image clients for cfg.Region.
+func newServiceClients(provider *gophercloud.ProviderClient, cfg *Config) (compute, block, image *gophercloud.ServiceClient, err error) {
+	compute, err = openstack.NewComputeV2(provider, endpointOpts(cfg, cfg.Region))
 	if err != nil {
-		return err
+		return nil, nil, nil, fmt.Errorf("compute client: %w", err)
 	}
-	defer rc.Close()
-	f, err := os.Create(outPath)
+	block, err = openstack.NewBlockStorageV3(provider, endpointOpts(cfg, cfg.Region))
 	if err != nil {
-		return err
+		return nil, nil, nil, fmt.Errorf("block storage client: %w", err)
 	}
-	n, err := io.Copy(f, rc)
-	f.Close()
+	image, err = openstack.NewImageV2(provider, endpointOpts(cfg, cfg.Region))
 	if err != nil {
-		os.Remove(outPath)
-		return err
+		return nil, nil, nil, fmt.Errorf("image client: %w", err)
 	}
-	if n == 0 {
-		os.Remove(outPath)
-		return fmt.Errorf("downloaded file is empty")
+	return compute, block, image, nil
+}
+
+// acquire takes a slot in sem (nil = unlimited) and returns the func that releases it.
+func acquire(ctx context.Context, sem chan struct{}) (func(), error) {
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	log.Printf("Downloaded %s", outPath)
-	log.Printf("Volume %s backed up", volID)
-	return nil
 }
 
 // Run performs the full backup using Gophercloud: discover or use VM list, then backs up all VMs in parallel; within each VM, volume backups run in parallel.
-func Run(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config) error {
-	computeClient, err := openstack.NewComputeV2(provider, gophercloud.EndpointOpts{Region: cfg.Region})
-	if err != nil {
-		return fmt.Errorf("compute client: %w", err)
+// With projects set, each project is backed up with its own scoped token under <target>/<project>.
+func Run(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config) (runErr error) {
+	if err := ValidateCompression(cfg); err != nil {
+		return err
+	}
+	if err := ValidateBackupMethod(cfg); err != nil {
+		return err
+	}
+	if err := ValidateHooks(cfg); err != nil {
+		return err
+	}
+	if err := ValidateVolumeDiscovery(cfg); err != nil {
+		return err
 	}
-	blockClient, err := openstack.NewBlockStorageV3(provider, gophercloud.EndpointOpts{Region: cfg.Region})
+	cinderBackup := cfg.BackupMethod == BackupMethodCinderBackup
+	if cinderBackup {
+		log.Printf("Backup method: %s (incremental: %t)", BackupMethodCinderBackup, cfg.CinderBackup.Incremental)
+		if cfg.Dedup || compressionCodec(cfg) != "" {
+			log.Printf("Warning: dedup and compression only apply to ephemeral root disks with %s", BackupMethodCinderBackup)
+		}
+	}
+	sink, err := NewSink(ctx, cfg, cfg.Target())
 	if err != nil {
-		return fmt.Errorf("block storage client: %w", err)
+		return err
+	}
+	log.Printf("Backup target: %s", sink)
+	if preErr := runHook(ctx, cfg, "pre_run", cfg.Hooks.PreRun, hookEnv{backupDir: sink.String()}); preErr != nil {
+		if cfg.Hooks.skipOnPreFailure() {
+			if err := runHook(ctx, cfg, "post_run", cfg.Hooks.PostRun, hookEnv{backupDir: sink.String(), result: HookResultSkipped, err: preErr}); err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			return preErr
+		}
+		log.Printf("Warning: %v; continuing", preErr)
 	}
-	imageClient, err := openstack.NewImageV2(provider, gophercloud.EndpointOpts{Region: cfg.Region})
+	defer func() {
+		env := hookEnv{backupDir: sink.String(), result: HookResultSuccess, err: runErr}
+		if runErr != nil {
+			env.result = HookResultFailure
+		}
+		if err := runHook(ctx, cfg, "post_run", cfg.Hooks.PostRun, env); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}()
+	lim := newRunLimits(cfg)
+	if len(cfg.Projects) > 0 {
+		return runProjects(ctx, provider, cfg, sink, lim)
+	}
+	return backupProject(ctx, provider, cfg, sink, lim)
+}
+
+// runLimits are the concurrency limits of a run, shared by all its projects.
+type runLimits struct {
+	// vm limits concurrent VM backup tasks; vol limits concurrent volume backups across all VMs.
+	// Nil = unlimited.
+	vm, vol chan struct{}
+}
+
+func newRunLimits(cfg *Config) *runLimits {
+	lim := &runLimits{}
+	if cfg.MaxParallelSnapShots > 0 {
+		lim.vm = make(chan struct{}, cfg.MaxParallelSnapShots)
+		log.Printf("Limiting to %d concurrent VM backup tasks", cfg.MaxParallelSnapShots)
+	}
+	if cfg.MaxParallelVolumes > 0 {
+		lim.vol = make(chan struct{}, cfg.MaxParallelVolumes)
+		log.Printf("Limiting to %d concurrent volume backups (snapshots)", cfg.MaxParallelVolumes)
+	}
+	return lim
+}
+
+// backupProject backs up the VMs and unattached volumes of provider's project into sink.
+func backupProject(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config, sink Sink, lim *runLimits) error {
+	computeClient, blockClient, imageClient, err := newServiceClients(provider, cfg)
 	if err != nil {
-		return fmt.Errorf("image client: %w", err)
+		return err
+	}
+	cinderBackup := cfg.BackupMethod == BackupMethodCinderBackup
+	var chunks *ChunkStore
+	if cfg.Dedup {
+		chunks, err = NewChunkStore(ctx, cfg, sink)
+		if err != nil {
+			return err
+		}
+		log.Printf("Dedup chunk store: %s", chunks)
+		if cfg.ChunkStore != "" {
+			if err := chunks.registerRoot(ctx, sink.String()); err != nil {
+				return fmt.Errorf("register %s in chunk store: %w", sink, err)
+			}
+		}
 	}
 
 	var vms []VMPair
-	if cfg.DiscoverAll {
+	switch {
+	case cfg.DiscoverVolumes == DiscoverVolumesUnattached:
+		log.Println("Backing up unattached volumes only")
+	case cfg.DiscoverAll:
 		if cfg.VMFilter != "" {
 			log.Printf("VM name filter: %s", cfg.VMFilter)
 		}
@@ -168,11 +369,11 @@ func Run(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config)
 		}
 		if len(discovered) == 0 {
 			log.Println("No VMs found")
-			return nil
+		} else {
+			log.Printf("Discovered %d VM(s)", len(discovered))
 		}
-		log.Printf("Discovered %d VM(s)", len(discovered))
 		vms = discovered
-	} else {
+	default:
 		log.Println("Using manual VM list")
 		for _, name := range cfg.VMList {
 			id, err := GetVMID(ctx, computeClient, name)
@@ -183,18 +384,16 @@ func Run(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config)
 			vms = append(vms, VMPair{name, id})
 		}
 	}
-
-	// Semaphore to limit concurrent VM backup tasks. Nil = unlimited.
-	var vmSem chan struct{}
-	if cfg.MaxParallelSnapShots > 0 {
-		vmSem = make(chan struct{}, cfg.MaxParallelSnapShots)
-		log.Printf("Limiting to %d concurrent VM backup tasks", cfg.MaxParallelSnapShots)
+	var detached []DetachedVolume
+	if cfg.DiscoverVolumes == DiscoverVolumesAll || cfg.DiscoverVolumes == DiscoverVolumesUnattached {
+		detached, err = DiscoverDetachedVolumes(ctx, blockClient, cfg)
+		if err != nil {
+			return err
+		}
+		log.Printf("Discovered %d unattached volume(s)", len(detached))
 	}
-	// Semaphore to limit concurrent volume backups (snapshot creation, etc.) across all VMs. Nil = unlimited.
-	var volSem chan struct{}
-	if cfg.MaxParallelVolumes > 0 {
-		volSem = make(chan struct{}, cfg.MaxParallelVolumes)
-		log.Printf("Limiting to %d concurrent volume backups (snapshots)", cfg.MaxParallelVolumes)
+	if len(vms) == 0 && len(detached) == 0 {
+		return nil
 	}
 
 	g, gCtx := errgroup.WithContext(ctx)
@@ -204,46 +403,155 @@ func Run(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config)
 			log.Printf("Skipping %s (invalid OpenStack VM)", v.Name)
 			continue
 		}
-		g.Go(func() error {
-			if vmSem != nil {
-				select {
-				case vmSem <- struct{}{}:
-					defer func() { <-vmSem }()
-				case <-gCtx.Done():
-					return gCtx.Err()
-				}
+		g.Go(func() (vmErr error) {
+			release, err := acquire(gCtx, lim.vm)
+			if err != nil {
+				return err
 			}
+			defer release()
 			log.Printf("==== VM: %s (ID: %s) ====", v.Name, v.ID)
-			vmDir := filepath.Join(cfg.BackupDir, v.Name, time.Now().Format("2006-01-02_15-04"))
-			if err := os.MkdirAll(vmDir, 0755); err != nil {
-				return fmt.Errorf("create %s: %w", vmDir, err)
+			runID := path.Join(v.Name, time.Now().Format(BackupTimeFormat))
+			vmDest := SubSink(sink, runID)
+			hookVM := hookEnv{vm: &v, backupDir: vmDest.String()}
+			if len(cfg.Projects) > 0 {
+				hookVM.project = cfg.Project
 			}
-			if err := BackupVMConfig(gCtx, computeClient, v.ID, vmDir); err != nil {
+			if preErr := runHook(gCtx, cfg, "pre_vm", cfg.Hooks.PreVM, hookVM); preErr != nil {
+				if cfg.Hooks.skipOnPreFailure() {
+					log.Printf("Warning: Skipping %s: %v", v.Name, preErr)
+					hookVM.result, hookVM.err = HookResultSkipped, preErr
+					if err := runHook(gCtx, cfg, "post_vm", cfg.Hooks.PostVM, hookVM); err != nil {
+						log.Printf("Warning: %v", err)
+					}
+					return nil
+				}
+				log.Printf("Warning: %v; backing up %s anyway", preErr, v.Name)
+			}
+			manifest := newRunManifest(cfg, v, chunks)
+			// Runs after the manifest is written, so the hook can read it.
+			defer func() {
+				hookVM.result, hookVM.err = HookResultSuccess, vmErr
+				if vmErr == nil && !manifest.Complete {
+					hookVM.err = fmt.Errorf("backup incomplete: %s", strings.Join(manifest.Errors, "; "))
+				}
+				if hookVM.err != nil {
+					hookVM.result = HookResultFailure
+				}
+				if err := runHook(gCtx, cfg, "post_vm", cfg.Hooks.PostVM, hookVM); err != nil {
+					log.Printf("Warning: %v", err)
+				}
+			}()
+			defer func() {
+				if err := manifest.Write(ctx, vmDest); err != nil {
+					log.Printf("Warning: Failed to write %s for %s: %v", ManifestFile, v.Name, err)
+				}
+			}()
+			confArts, err := BackupVMConfig(gCtx, computeClient, v.ID, vmDest)
+			if err != nil {
 				log.Printf("Failed VM config backup for %s: %v", v.Name, err)
+				manifest.AddError(fmt.Errorf("vm config: %w", err))
 			}
-			vols, err := GetAttachedVolumes(gCtx, blockClient, v.ID)
+			manifest.Add(confArts...)
+			vols, err := GetAttachedVolumes(gCtx, blockClient, cfg, v.ID)
 			if err != nil {
+				manifest.AddError(fmt.Errorf("list volumes: %w", err))
 				return fmt.Errorf("%s: list volumes: %w", v.Name, err)
 			}
-			if len(vols) == 0 {
+			srv, err := servers.Get(gCtx, computeClient, v.ID).Extract()
+			if err != nil {
+				manifest.AddError(fmt.Errorf("get server: %w", err))
+				return fmt.Errorf("%s: get server: %w", v.Name, err)
+			}
+			var rootSrv *servers.Server
+			if !cfg.SkipEphemeralRoot && bootImageID(srv) != "" {
+				rootSrv = srv
+			}
+			if len(vols) == 0 && rootSrv == nil {
 				log.Printf("No volumes for %s", v.Name)
 				return nil
 			}
+			volIDs := make([]string, len(vols))
+			for i, att := range vols {
+				volIDs[i] = att.VolumeID
+			}
+			quiesce := quiesceWanted(cfg, srv)
+			rootQuiesced := quiesce && rootSrv != nil && guestAgentQuiesce(gCtx, imageClient, rootSrv)
+			// Snapshots taken up front, by volume ID: a group snapshot's members, or the snapshots
+			// taken while the guest was frozen. Other volumes are snapshotted by their backup.
+			var taken map[string]*takenSnapshot
+			var freezer *guestFreezer
+			if quiesce && len(vols) > 0 {
+				freezer = newGuestFreezer(cfg, v, volIDs)
+			}
+			if cfg.GroupSnapshots && len(vols) > 1 {
+				group, err := createGroupSnapshot(gCtx, blockClient, cfg, freezer, v.Name, volIDs)
+				if group != nil {
+					defer group.Delete(ctx, volIDs)
+				}
+				if err != nil {
+					log.Printf("Warning: Failed to create group snapshot for %s (snapshotting volumes separately): %v", v.Name, err)
+				} else {
+					taken = map[string]*takenSnapshot{}
+					for volID, snapID := range group.Members {
+						taken[volID] = &takenSnapshot{ID: snapID, GroupSnapshotID: group.ID}
+					}
+				}
+			}
+			if freezer != nil && taken == nil {
+				keep := cfg.SnapshotRetention > 0 && !cinderBackup
+				taken, err = snapshotVolumes(gCtx, blockClient, cfg, freezer, volIDs, runID, keep)
+				if err == nil {
+					defer deleteUnusedSnapshots(ctx, blockClient, taken)
+				}
+			}
+			if err != nil {
+				manifest.AddError(err)
+				return fmt.Errorf("%s: %w", v.Name, err)
+			}
 			g2, g2Ctx := errgroup.WithContext(gCtx)
-			for _, volID := range vols {
-				volID := volID
+			if rootSrv != nil {
 				g2.Go(func() error {
-					if volSem != nil {
-						select {
-						case volSem <- struct{}{}:
-							defer func() { <-volSem }()
-						case <-g2Ctx.Done():
-							return g2Ctx.Err()
-						}
+					release, err := acquire(g2Ctx, lim.vol)
+					if err != nil {
+						return err
+					}
+					defer release()
+					art, err := BackupRootDisk(g2Ctx, computeClient, imageClient, cfg, rootSrv, vmDest, chunks)
+					if err != nil {
+						err = fmt.Errorf("root disk: %w", err)
+						manifest.AddError(err)
+						return err
 					}
-					if err := BackupVolume(g2Ctx, blockClient, imageClient, cfg, volID, vmDir); err != nil {
-						return fmt.Errorf("volume %s: %w", volID, err)
+					if rootQuiesced {
+						art.Volume.Quiesce = QuiesceGuestAgent
 					}
+					manifest.Add(*art)
+					return nil
+				})
+			}
+			for _, att := range vols {
+				att := att
+				volID := att.VolumeID
+				snap := taken[volID]
+				g2.Go(func() error {
+					release, err := acquire(g2Ctx, lim.vol)
+					if err != nil {
+						return err
+					}
+					defer release()
+					var art *Artifact
+					if cinderBackup {
+						art, err = BackupVolumeCinder(g2Ctx, blockClient, cfg, att, vmDest, v.Name, snap)
+					} else {
+						art, err = BackupVolume(g2Ctx, blockClient, imageClient, cfg, att, vmDest, chunks, runID, snap)
+					}
+					if err != nil {
+						err = fmt.Errorf("volume %s: %w", volID, err)
+						manifest.AddError(err)
+						return err
+					}
+					freezer.record(art.Volume)
+					manifest.Add(*art)
 					return nil
 				})
 			}
@@ -254,5 +562,106 @@ func Run(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config)
 			return nil
 		})
 	}
-	return g.Wait()
+	for _, dv := range detached {
+		dv := dv
+		g.Go(func() error {
+			release, err := acquire(gCtx, lim.vol)
+			if err != nil {
+				return err
+			}
+			defer release()
+			return backupDetachedVolume(gCtx, blockClient, imageClient, cfg, dv, sink, chunks)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	if cfg.PruneAfterRun {
+		log.Println("Applying retention policy")
+		for _, v := range vms {
+			if _, err := PruneVM(ctx, blockClient, sink, cfg, v.Name, false); err != nil {
+				return fmt.Errorf("prune %s: %w", v.Name, err)
+			}
+		}
+		for _, dv := range detached {
+			name := path.Join(DetachedVolumesDir, dv.Dir)
+			if _, err := PruneVM(ctx, blockClient, sink, cfg, name, false); err != nil {
+				return fmt.Errorf("prune %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// backupVolumeConfig writes the volume's details to dest as volume-config.json.
+func backupVolumeConfig(ctx context.Context, vol *volumes.Volume, dest Sink, manifest *Manifest) error {
+	data, err := json.MarshalIndent(map[string]any{"volume": vol}, "", "  ")
+	if err != nil {
+		return err
+	}
+	art, err := writeConfigArtifact(ctx, dest, "volume-config.json", data)
+	if err != nil {
+		return err
+	}
+	manifest.Add(art)
+	return nil
+}
+
+// newRunManifest starts the manifest of one VM (or unattached volume) backup run.
+func newRunManifest(cfg *Config, vm VMPair, chunks *ChunkStore) *Manifest {
+	manifest := NewManifest(vm, cfg.DiskFormat)
+	manifest.Compression = compressionCodec(cfg)
+	if cfg.BackupMethod == BackupMethodCinderBackup {
+		manifest.BackupMethod = BackupMethodCinderBackup
+	}
+	if chunks != nil {
+		manifest.ChunkStore = chunks.String()
+	}
+	if cfg.Encryption.Enabled() {
+		manifest.Encryption = EncryptionCipher
+	}
+	if len(cfg.Projects) > 0 {
+		manifest.ProjectID, manifest.ProjectName = cfg.ProjectID, cfg.Project
+	}
+	return manifest
+}
+
+// backupDetachedVolume backs up an unattached volume into _volumes/<dir>/YYYY-MM-DD_HH-MM/ of sink:
+// its details as volume-config.json and its data like an attached volume, with a manifest.
+func backupDetachedVolume(ctx context.Context, blockClient, imageClient *gophercloud.ServiceClient, cfg *Config, dv DetachedVolume, sink Sink, chunks *ChunkStore) error {
+	log.Printf("==== Volume: %s (ID: %s) ====", dv.Dir, dv.ID)
+	runID := path.Join(DetachedVolumesDir, dv.Dir, time.Now().Format(BackupTimeFormat))
+	dest := SubSink(sink, runID)
+	manifest := newRunManifest(cfg, VMPair{}, chunks)
+	manifest.VolumeID = dv.ID
+	defer func() {
+		if err := manifest.Write(ctx, dest); err != nil {
+			log.Printf("Warning: Failed to write %s for volume %s: %v", ManifestFile, dv.Dir, err)
+		}
+	}()
+	vol, err := volumes.Get(ctx, blockClient, dv.ID).Extract()
+	if err != nil {
+		manifest.AddError(fmt.Errorf("get volume: %w", err))
+		return fmt.Errorf("volume %s: %w", dv.Dir, err)
+	}
+	manifest.VolumeName = vol.Name
+	if err := backupVolumeConfig(ctx, vol, dest, manifest); err != nil {
+		log.Printf("Failed volume config backup for %s: %v", dv.Dir, err)
+		manifest.AddError(fmt.Errorf("volume config: %w", err))
+	}
+	att := VolumeAttachment{VolumeID: dv.ID}
+	var art *Artifact
+	if cfg.BackupMethod == BackupMethodCinderBackup {
+		art, err = BackupVolumeCinder(ctx, blockClient, cfg, att, dest, vol.Name, nil)
+	} else {
+		art, err = BackupVolume(ctx, blockClient, imageClient, cfg, att, dest, chunks, runID, nil)
+	}
+	if err != nil {
+		err = fmt.Errorf("volume %s: %w", dv.ID, err)
+		manifest.AddError(err)
+		return fmt.Errorf("%s: %w", dv.Dir, err)
+	}
+	manifest.Add(*art)
+	log.Printf("Completed: volume %s", dv.Dir)
+	return nil
 }
@@ -0,0 +1,531 @@
+package ostack
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/bits"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ChunkDir is the default chunk store location inside the backup target.
+// Top-level names starting with "_" are reserved and never treated as VM directories.
+const ChunkDir = "_chunks"
+
+// chunkRootsDir holds, in a chunk_store shared by several backup targets, one object per target
+// that has stored chunks in it, so GC can read the chunk indexes of all of them.
+const chunkRootsDir = "_roots"
+
+// ChunkIndexSuffix is appended to <volID>.<format> for the per-backup chunk index of a deduplicated image.
+const ChunkIndexSuffix = ".chunks"
+
+const (
+	defaultDedupAvgChunkKB = 1024
+	// chunkUploadWorkers is how many new chunks of one image are uploaded concurrently.
+	chunkUploadWorkers = 8
+)
+
+// ChunkIndex lists the chunks of one deduplicated disk image, in order.
+type ChunkIndex struct {
+	Format string `json:"format"`
+	// Compression is the codec each chunk is stored with, if any.
+	Compression string `json:"compression,omitempty"`
+	// Size and SHA256 are of the whole reassembled image.
+	Size   int64      `json:"size"`
+	SHA256 string     `json:"sha256"`
+	Chunks []ChunkRef `json:"chunks"`
+}
+
+// ChunkRef is one chunk of an image: the SHA-256 of its content and its size.
+type ChunkRef struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// ChunkStore is a content-addressed store of image chunks, keyed <id[:2]>/<id>[.gz|.zst].
+// Chunks are shared by every deduplicated backup in the store.
+type ChunkStore struct {
+	sink Sink
+
+	mu     sync.Mutex
+	known  map[string]bool
+	loaded bool
+}
+
+// NewChunkStore returns the chunk store for cfg: chunk_store if set, else root/_chunks.
+func NewChunkStore(ctx context.Context, cfg *Config, root Sink) (*ChunkStore, error) {
+	if cfg.ChunkStore == "" {
+		return &ChunkStore{sink: SubSink(root, ChunkDir)}, nil
+	}
+	s, err := NewSink(ctx, cfg, cfg.ChunkStore)
+	if err != nil {
+		return nil, fmt.Errorf("chunk store: %w", err)
+	}
+	return &ChunkStore{sink: s}, nil
+}
+
+// chunkStoreForRun returns the chunk store of a VM/TIMESTAMP run: chunk_store if set,
+// else _chunks two levels above the run (three for a _volumes/DIR/TIMESTAMP run).
+func chunkStoreForRun(ctx context.Context, cfg *Config, run Sink) (*ChunkStore, error) {
+	if cfg.ChunkStore != "" {
+		return NewChunkStore(ctx, cfg, nil)
+	}
+	vmDir, _ := splitTarget(run.String())
+	rootDir, _ := splitTarget(vmDir)
+	if parent, name := splitTarget(rootDir); name == DetachedVolumesDir {
+		rootDir = parent
+	}
+	root, err := NewSink(ctx, cfg, rootDir)
+	if err != nil {
+		return nil, err
+	}
+	return NewChunkStore(ctx, cfg, root)
+}
+
+// chunkRoot is the registry entry of a backup target that stores chunks in a shared chunk store.
+type chunkRoot struct {
+	Target string `json:"target"`
+}
+
+// registerRoot records target in the chunk store, so that GC run against any target sharing the
+// store also keeps the chunks referenced under target.
+func (cs *ChunkStore) registerRoot(ctx context.Context, target string) error {
+	target = absTarget(target)
+	data, err := json.Marshal(chunkRoot{Target: target})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(target))
+	return writeObject(ctx, cs.sink, chunkRootsDir+"/"+hex.EncodeToString(sum[:8])+".json", data)
+}
+
+// ChunkStoreRoots returns the backup targets whose chunk indexes GC must read before removing
+// chunks from cs: root, and for a chunk_store every target registered in it by a backup. A
+// registered target is opened with the config in cfgs whose backup target contains it (e.g. its
+// targets entry), else with cfgs[0]. It fails if any of them cannot be opened, rather than let GC
+// remove chunks that target still references.
+func ChunkStoreRoots(ctx context.Context, cfgs []*Config, cs *ChunkStore, root Sink) ([]Sink, error) {
+	roots := []Sink{root}
+	if cfgs[0].ChunkStore == "" {
+		return roots, nil
+	}
+	objs, err := cs.sink.List(ctx, chunkRootsDir+"/")
+	if err != nil {
+		return nil, fmt.Errorf("list chunk store targets: %w", err)
+	}
+	seen := map[string]bool{absTarget(root.String()): true}
+	for _, o := range objs {
+		data, err := readObject(ctx, cs.sink, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		var r chunkRoot
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", o.Key, err)
+		}
+		if seen[r.Target] {
+			continue
+		}
+		seen[r.Target] = true
+		s, err := NewSink(ctx, targetConfigFor(cfgs, r.Target), r.Target)
+		if err != nil {
+			return nil, fmt.Errorf("chunk store is shared with %s: %w", r.Target, err)
+		}
+		roots = append(roots, s)
+	}
+	return roots, nil
+}
+
+// targetConfigFor returns the config in cfgs with the longest backup target containing target,
+// else cfgs[0].
+func targetConfigFor(cfgs []*Config, target string) *Config {
+	best, bestLen := cfgs[0], -1
+	for _, c := range cfgs {
+		t := strings.TrimRight(absTarget(c.Target()), `/\`)
+		if (target == t || strings.HasPrefix(target, t+"/") || strings.HasPrefix(target, t+string(filepath.Separator))) && len(t) > bestLen {
+			best, bestLen = c, len(t)
+		}
+	}
+	return best
+}
+
+// absTarget makes a local path target absolute, so that it names the same directory from any
+// working directory; URL targets are returned unchanged.
+func absTarget(target string) string {
+	if strings.Contains(target, "://") {
+		return target
+	}
+	if abs, err := filepath.Abs(target); err == nil {
+		return abs
+	}
+	return target
+}
+
+func (cs *ChunkStore) String() string {
+	return cs.sink.String()
+}
+
+func chunkKey(id, codec string) string {
+	return id[:2] + "/" + id + compressionSuffixes[codec]
+}
+
+// has reports whether key is stored, listing the store once on first use.
+func (cs *ChunkStore) has(ctx context.Context, key string) (bool, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if !cs.loaded {
+		objs, err := cs.sink.List(ctx, "")
+		if err != nil {
+			return false, fmt.Errorf("list chunk store: %w", err)
+		}
+		cs.known = make(map[string]bool, len(objs))
+		for _, o := range objs {
+			cs.known[o.Key] = true
+		}
+		cs.loaded = true
+	}
+	return cs.known[key], nil
+}
+
+// put stores a chunk (compressed with codec) unless it is already present. Reports whether it was written.
+func (cs *ChunkStore) put(ctx context.Context, cfg *Config, id, codec string, data []byte) (bool, error) {
+	key := chunkKey(id, codec)
+	if ok, err := cs.has(ctx, key); err != nil || ok {
+		return false, err
+	}
+	if codec != "" {
+		var buf bytes.Buffer
+		zw, err := newCompressWriter(&buf, cfg)
+		if err != nil {
+			return false, err
+		}
+		if _, err := zw.Write(data); err != nil {
+			return false, err
+		}
+		if err := zw.Close(); err != nil {
+			return false, err
+		}
+		data = buf.Bytes()
+	}
+	if err := writeObject(ctx, cs.sink, key, data); err != nil {
+		return false, fmt.Errorf("store chunk %s: %w", id, err)
+	}
+	cs.mu.Lock()
+	cs.known[key] = true
+	cs.mu.Unlock()
+	return true, nil
+}
+
+// get returns a chunk's content, checking it against its ID.
+func (cs *ChunkStore) get(ctx context.Context, id, codec string) ([]byte, error) {
+	key := chunkKey(id, codec)
+	rc, err := cs.sink.Open(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id, err)
+	}
+	rc, err = openDecompressed(rc, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", id, err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("chunk %s: SHA-256 mismatch", id)
+	}
+	return data, nil
+}
+
+// storeChunked splits r into content-defined chunks, stores the new ones in cs, and writes the
+// chunk index dest/name.chunks (with its checksum sidecar). Returns the index's manifest entry.
+func storeChunked(ctx context.Context, cfg *Config, cs *ChunkStore, r io.Reader, dest Sink, name, format string) (*Artifact, error) {
+	codec := compressionCodec(cfg)
+	idx := &ChunkIndex{Format: format, Compression: codec}
+	whole := sha256.New()
+	var newChunks, newBytes int64
+	var mu sync.Mutex
+	g, gCtx := errgroup.WithContext(ctx)
+	g.SetLimit(chunkUploadWorkers)
+	ch := newChunker(r, cfg.DedupAvgChunkKB)
+	for {
+		data, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			g.Wait()
+			return nil, err
+		}
+		if gCtx.Err() != nil {
+			break
+		}
+		whole.Write(data)
+		sum := sha256.Sum256(data)
+		id := hex.EncodeToString(sum[:])
+		idx.Chunks = append(idx.Chunks, ChunkRef{ID: id, Size: int64(len(data))})
+		idx.Size += int64(len(data))
+		data = bytes.Clone(data)
+		g.Go(func() error {
+			stored, err := cs.put(gCtx, cfg, id, codec, data)
+			if stored {
+				mu.Lock()
+				newChunks++
+				newBytes += int64(len(data))
+				mu.Unlock()
+			}
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	if idx.Size == 0 {
+		return nil, fmt.Errorf("downloaded file is empty")
+	}
+	idx.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	art, err := writeConfigArtifact(ctx, dest, name+ChunkIndexSuffix, data)
+	if err != nil {
+		return nil, fmt.Errorf("write chunk index: %w", err)
+	}
+	art.UncompressedBytes = idx.Size
+	log.Printf("Stored %s/%s: %d bytes in %d chunks, %d new (%d bytes)", dest, art.File, idx.Size, len(idx.Chunks), newChunks, newBytes)
+	return &art, nil
+}
+
+// readChunkIndex reads a chunk index file from src.
+func readChunkIndex(ctx context.Context, src Sink, key string) (*ChunkIndex, error) {
+	data, err := readObject(ctx, src, key)
+	if err != nil {
+		return nil, err
+	}
+	idx := &ChunkIndex{}
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", key, err)
+	}
+	return idx, nil
+}
+
+// chunkedReader reassembles an image from its chunks, verifying each one.
+type chunkedReader struct {
+	ctx  context.Context
+	cs   *ChunkStore
+	idx  *ChunkIndex
+	next int
+	buf  []byte
+}
+
+func newChunkedReader(ctx context.Context, cs *ChunkStore, idx *ChunkIndex) io.ReadCloser {
+	return &chunkedReader{ctx: ctx, cs: cs, idx: idx}
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.next >= len(r.idx.Chunks) {
+			return 0, io.EOF
+		}
+		c := r.idx.Chunks[r.next]
+		data, err := r.cs.get(r.ctx, c.ID, r.idx.Compression)
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(data)) != c.Size {
+			return 0, fmt.Errorf("chunk %s: size %d, index says %d", c.ID, len(data), c.Size)
+		}
+		r.buf = data
+		r.next++
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *chunkedReader) Close() error {
+	return nil
+}
+
+// GCResult counts the chunks kept and removed (or, for a dry run, that would be removed) by GC.
+type GCResult struct {
+	Referenced   int
+	Removed      int
+	RemovedBytes int64
+}
+
+// GC removes chunks that no chunk index under roots references (e.g. after prune). roots must
+// include every backup target that stores chunks in cs (see ChunkStoreRoots). With dryRun, nothing
+// is removed. Do not run it while a backup into the same store is in progress: chunks written
+// before their index would be removed.
+func GC(ctx context.Context, roots []Sink, cs *ChunkStore, dryRun bool) (*GCResult, error) {
+	referenced := map[string]bool{}
+	for _, root := range roots {
+		if err := addReferencedChunks(ctx, root, referenced); err != nil {
+			return nil, fmt.Errorf("%s: %w", root, err)
+		}
+	}
+	objs, err := cs.sink.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("list chunk store: %w", err)
+	}
+	res := &GCResult{Referenced: len(referenced)}
+	for _, o := range objs {
+		if referenced[o.Key] || strings.HasPrefix(o.Key, chunkRootsDir+"/") {
+			continue
+		}
+		res.Removed++
+		res.RemovedBytes += o.Size
+		if dryRun {
+			continue
+		}
+		if err := cs.sink.Delete(ctx, o.Key); err != nil {
+			return res, fmt.Errorf("remove chunk %s: %w", o.Key, err)
+		}
+	}
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+	log.Printf("GC %s: %d chunk(s) referenced, %s %d unreferenced chunk(s) (%d bytes)", cs, res.Referenced, verb, res.Removed, res.RemovedBytes)
+	return res, nil
+}
+
+// addReferencedChunks adds the chunk keys of every chunk index in sink to referenced.
+func addReferencedChunks(ctx context.Context, sink Sink, referenced map[string]bool) error {
+	vms, err := listVMNames(ctx, sink)
+	if err != nil {
+		return err
+	}
+	for _, vm := range vms {
+		objs, err := sink.List(ctx, vm+"/")
+		if err != nil {
+			return err
+		}
+		for _, o := range objs {
+			if !strings.HasSuffix(o.Key, ChunkIndexSuffix) {
+				continue
+			}
+			idx, err := readChunkIndex(ctx, sink, o.Key)
+			if err != nil {
+				// A missing chunk list would make GC remove live chunks; stop instead.
+				return fmt.Errorf("read %s: %w", o.Key, err)
+			}
+			for _, c := range idx.Chunks {
+				referenced[chunkKey(c.ID, idx.Compression)] = true
+			}
+		}
+	}
+	return nil
+}
+
+// chunker splits a stream into content-defined chunks with FastCDC (normalized chunking over a
+// gear rolling hash), so an insertion or change only affects the chunks around it.
+type chunker struct {
+	r                io.Reader
+	buf              []byte
+	start, end       int
+	eof              bool
+	min, avg, max    int
+	maskHard, maskEz uint64
+}
+
+// gearTable holds 256 fixed pseudo-random values (splitmix64). They must never change:
+// chunk boundaries, and so deduplication across runs, depend on them.
+var gearTable = func() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x70726f746563742d)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+func newChunker(r io.Reader, avgKB int) *chunker {
+	if avgKB <= 0 {
+		avgKB = defaultDedupAvgChunkKB
+	}
+	avg := avgKB << 10
+	b := bits.Len(uint(avg)) - 1 // log2(avg)
+	return &chunker{
+		r:   r,
+		min: avg / 4,
+		avg: avg,
+		max: avg * 4,
+		buf: make([]byte, avg*8),
+		// Top bits of the gear hash depend on the last 64 bytes. Before the average size a
+		// harder mask (2 more bits) makes cuts rarer; after it an easier one makes them likelier.
+		maskHard: ^uint64(0) << (64 - (b + 2)),
+		maskEz:   ^uint64(0) << (64 - (b - 2)),
+	}
+}
+
+// Next returns the next chunk, valid until the following call, or io.EOF.
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.max && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.r.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the first chunk of data.
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskHard == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskEz == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
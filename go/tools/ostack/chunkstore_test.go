@@ -0,0 +1,166 @@
+package ostack
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func chunkAll(t *testing.T, r io.Reader, avgKB int) [][]byte {
+	t.Helper()
+	c := newChunker(r, avgKB)
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	const avgKB = 16
+	min, max := avgKB<<10/4, avgKB<<10*4
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"below min", randomData(1, min-1)},
+		{"exactly min", randomData(2, min)},
+		{"random", randomData(3, 2<<20)},
+		{"zeros", make([]byte, 1<<20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := chunkAll(t, bytes.NewReader(tt.data), avgKB)
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, tt.data) {
+				t.Fatalf("chunks join to %d bytes, want the %d input bytes", len(got), len(tt.data))
+			}
+			for i, c := range chunks {
+				last := i == len(chunks)-1
+				if len(c) > max || len(c) == 0 || (!last && len(c) < min) {
+					t.Errorf("chunk %d/%d has %d bytes (min %d, max %d)", i, len(chunks), len(c), min, max)
+				}
+			}
+			if len(tt.data) <= min && len(chunks) > 1 {
+				t.Errorf("%d chunks for %d bytes, want 1", len(chunks), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestChunkerAverageSize(t *testing.T) {
+	const avgKB = 16
+	data := randomData(4, 8<<20)
+	chunks := chunkAll(t, bytes.NewReader(data), avgKB)
+	avg := len(data) / len(chunks)
+	if avg < avgKB<<10/2 || avg > avgKB<<10*2 {
+		t.Errorf("average chunk size %d, want about %d", avg, avgKB<<10)
+	}
+}
+
+func TestChunkerDeterministic(t *testing.T) {
+	data := randomData(5, 1<<20)
+	want := chunkAll(t, bytes.NewReader(data), 16)
+	// Boundaries depend only on the content, not on how the reader splits its reads.
+	got := chunkAll(t, iotest.HalfReader(iotest.OneByteReader(bytes.NewReader(data))), 16)
+	if len(got) != len(want) {
+		t.Fatalf("%d chunks with short reads, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("chunk %d differs with short reads", i)
+		}
+	}
+}
+
+func TestChunkerShiftResistance(t *testing.T) {
+	data := randomData(6, 4<<20)
+	ids := func(chunks [][]byte) map[[32]byte]bool {
+		m := map[[32]byte]bool{}
+		for _, c := range chunks {
+			m[sha256.Sum256(c)] = true
+		}
+		return m
+	}
+	before := ids(chunkAll(t, bytes.NewReader(data), 16))
+	edited := append(append(append([]byte(nil), data[:1<<20]...), "inserted bytes"...), data[1<<20:]...)
+	after := chunkAll(t, bytes.NewReader(edited), 16)
+	shared := 0
+	for _, c := range after {
+		if before[sha256.Sum256(c)] {
+			shared++
+		}
+	}
+	// An insertion only changes the chunks around it.
+	if changed := len(after) - shared; changed > 3 {
+		t.Errorf("%d of %d chunks changed after a 14-byte insertion, want at most 3", changed, len(after))
+	}
+}
+
+func TestGCSharedChunkStore(t *testing.T) {
+	ctx := context.Background()
+	a, b := t.TempDir(), t.TempDir()
+	cfg := &Config{ChunkStore: t.TempDir(), DedupAvgChunkKB: 16}
+	cs, err := NewChunkStore(ctx, cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := map[string][]byte{a: randomData(7, 512<<10), b: randomData(8, 512<<10)}
+	for root, data := range images {
+		if err := cs.registerRoot(ctx, root); err != nil {
+			t.Fatal(err)
+		}
+		run := SubSink(NewFileSink(root), "vm1/2026-03-01_10-00")
+		if _, err := storeChunked(ctx, cfg, cs, bytes.NewReader(data), run, "vol.raw", "raw"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	orphan := chunkKey(strings.Repeat("ab", 32), "")
+	if err := writeObject(ctx, cs.sink, orphan, []byte("unreferenced")); err != nil {
+		t.Fatal(err)
+	}
+
+	// GC run against target a must also keep the chunks of target b.
+	roots, err := ChunkStoreRoots(ctx, []*Config{cfg}, cs, NewFileSink(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 {
+		t.Fatalf("roots = %v, want both targets", roots)
+	}
+	res, err := GC(ctx, roots, cs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Removed != 1 {
+		t.Errorf("removed %d chunks, want only the unreferenced one", res.Removed)
+	}
+	if _, err := readObject(ctx, cs.sink, orphan); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unreferenced chunk: err = %v, want it removed", err)
+	}
+	for root, data := range images {
+		run := SubSink(NewFileSink(root), "vm1/2026-03-01_10-00")
+		idx, err := readChunkIndex(ctx, run, "vol.raw"+ChunkIndexSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(newChunkedReader(ctx, cs, idx))
+		if err != nil {
+			t.Fatalf("%s: %v", root, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: reassembled image differs", root)
+		}
+	}
+}
@@ -3,16 +3,26 @@ package ostack
 import (
 	"context"
 	"fmt"
+	"log"
+	"slices"
+	"strings"
 
 	"github.com/gophercloud/gophercloud/v2"
 	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
 	"github.com/gophercloud/gophercloud/v2/pagination"
 )
 
-// GetAttachedVolumes returns volume IDs attached to the given server.
-func GetAttachedVolumes(ctx context.Context, client *gophercloud.ServiceClient, serverID string) ([]string, error) {
-	var ids []string
-	err := volumes.List(client, volumes.ListOpts{AllTenants: true}).EachPage(ctx, func(ctx context.Context, page pagination.Page) (bool, error) {
+// VolumeAttachment is a volume attached to a server and the device path it is attached at.
+type VolumeAttachment struct {
+	VolumeID string
+	Device   string
+}
+
+// GetAttachedVolumes returns the volumes attached to the given server. A multi-project run lists
+// only the current project's volumes, with its project-scoped token.
+func GetAttachedVolumes(ctx context.Context, client *gophercloud.ServiceClient, cfg *Config, serverID string) ([]VolumeAttachment, error) {
+	var atts []VolumeAttachment
+	err := volumes.List(client, volumes.ListOpts{AllTenants: len(cfg.Projects) == 0}).EachPage(ctx, func(ctx context.Context, page pagination.Page) (bool, error) {
 		volList, err := volumes.ExtractVolumes(page)
 		if err != nil {
 			return false, err
@@ -20,14 +30,14 @@ func GetAttachedVolumes(ctx context.Context, client *gophercloud.ServiceClient,
 		for _, v := range volList {
 			for _, a := range v.Attachments {
 				if a.ServerID == serverID {
-					ids = append(ids, v.ID)
+					atts = append(atts, VolumeAttachment{VolumeID: v.ID, Device: a.Device})
 					break
 				}
 			}
 		}
 		return true, nil
 	})
-	return ids, err
+	return atts, err
 }
 
 // GetVolumeSize returns the volume size in GB.
@@ -41,3 +51,104 @@ func GetVolumeSize(ctx context.Context, client *gophercloud.ServiceClient, volID
 	}
 	return v.Size, nil
 }
+
+// Volume discovery modes (discover_volumes).
+const (
+	// DiscoverVolumesAttached backs up the volumes attached to the selected VMs (default).
+	DiscoverVolumesAttached = "attached"
+	// DiscoverVolumesAll also backs up unattached volumes.
+	DiscoverVolumesAll = "all"
+	// DiscoverVolumesUnattached backs up only unattached volumes, and no VMs.
+	DiscoverVolumesUnattached = "unattached"
+)
+
+// DetachedVolumesDir is the top-level directory of unattached volume backups:
+// BACKUP_DIR/_volumes/<volname>-<id[:8]>/YYYY-MM-DD_HH-MM/.
+const DetachedVolumesDir = "_volumes"
+
+// TempVolumeMetaKey marks the temporary volumes created during a backup, so that volume
+// discovery does not back them up.
+const TempVolumeMetaKey = "protect-ostack:temp"
+
+// DetachedVolume is an unattached volume selected for backup.
+type DetachedVolume struct {
+	// Dir is the volume's directory under _volumes (see detachedVolumeDir).
+	Dir string
+	ID  string
+}
+
+// ValidateVolumeDiscovery checks discover_volumes in cfg.
+func ValidateVolumeDiscovery(cfg *Config) error {
+	switch cfg.DiscoverVolumes {
+	case "", DiscoverVolumesAttached, DiscoverVolumesAll, DiscoverVolumesUnattached:
+		return nil
+	}
+	return fmt.Errorf("unsupported discover_volumes %q (supported: %s, %s, %s)", cfg.DiscoverVolumes, DiscoverVolumesAttached, DiscoverVolumesAll, DiscoverVolumesUnattached)
+}
+
+// DiscoverDetachedVolumes returns the available, unattached volumes matching volume_filter,
+// volume_metadata, and volume_types.
+func DiscoverDetachedVolumes(ctx context.Context, client *gophercloud.ServiceClient, cfg *Config) ([]DetachedVolume, error) {
+	log.Println("Discovering unattached volumes from OpenStack...")
+	var found []volumes.Volume
+	err := volumes.List(client, volumes.ListOpts{AllTenants: len(cfg.Projects) == 0, Status: "available"}).EachPage(ctx, func(ctx context.Context, page pagination.Page) (bool, error) {
+		volList, err := volumes.ExtractVolumes(page)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range volList {
+			if v.Status != "available" || len(v.Attachments) > 0 {
+				continue
+			}
+			if _, ok := v.Metadata[TempVolumeMetaKey]; ok {
+				continue
+			}
+			if !matchNameFilter(v.Name, cfg.VolumeFilter) || !matchVolumeMetadata(v.Metadata, cfg.VolumeMetadata) {
+				continue
+			}
+			if len(cfg.VolumeTypes) > 0 && !slices.Contains(cfg.VolumeTypes, v.VolumeType) {
+				continue
+			}
+			found = append(found, v)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]DetachedVolume, 0, len(found))
+	for _, v := range found {
+		result = append(result, DetachedVolume{Dir: detachedVolumeDir(v), ID: v.ID})
+	}
+	return result, nil
+}
+
+// detachedVolumeIDPrefix is how many characters of the volume ID follow its name in its directory.
+const detachedVolumeIDPrefix = 8
+
+// detachedVolumeDir returns the directory of an unattached volume under _volumes:
+// <name>-<first 8 characters of the ID>, or the ID if the name is empty or not usable as a
+// directory name. It depends only on the volume, not on the other volumes of the run, so the
+// volume's runs stay in one directory as long as it keeps its name.
+func detachedVolumeDir(v volumes.Volume) string {
+	if v.Name == "" || strings.ContainsAny(v.Name, `/\`) || strings.HasPrefix(v.Name, ".") {
+		return v.ID
+	}
+	return v.Name + "-" + v.ID[:min(len(v.ID), detachedVolumeIDPrefix)]
+}
+
+// matchVolumeMetadata reports whether meta matches all key:value pairs of filter
+// (comma-separated, like vm_tags); a key without value only has to be present.
+func matchVolumeMetadata(meta map[string]string, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	for _, pair := range strings.Split(filter, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		v, ok := meta[strings.TrimSpace(kv[0])]
+		if !ok || (len(kv) > 1 && v != strings.TrimSpace(kv[1])) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package ostack
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+)
+
+func TestDetachedVolumeDir(t *testing.T) {
+	tests := []struct {
+		name string
+		vol  volumes.Volume
+		want string
+	}{
+		{"name and ID prefix", volumes.Volume{ID: "3f2a9c1e-0000-4000-8000-000000000001", Name: "data"}, "data-3f2a9c1e"},
+		{"no name", volumes.Volume{ID: "3f2a9c1e-0000-4000-8000-000000000001"}, "3f2a9c1e-0000-4000-8000-000000000001"},
+		{"slash in name", volumes.Volume{ID: "3f2a9c1e-0000-4000-8000-000000000001", Name: "a/b"}, "3f2a9c1e-0000-4000-8000-000000000001"},
+		{"dot name", volumes.Volume{ID: "3f2a9c1e-0000-4000-8000-000000000001", Name: ".."}, "3f2a9c1e-0000-4000-8000-000000000001"},
+		{"short ID", volumes.Volume{ID: "v1", Name: "data"}, "data-v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detachedVolumeDir(tt.vol); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiscoverDetachedVolumes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/volumes/detail" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"volumes": [
+			{"id": "aaaaaaaa-1", "name": "data", "status": "available", "volume_type": "ssd", "metadata": {"backup": "yes"}},
+			{"id": "bbbbbbbb-2", "name": "data", "status": "available", "volume_type": "ssd", "metadata": {"backup": "yes"}},
+			{"id": "cccccccc-3", "name": "logs", "status": "available", "volume_type": "hdd", "metadata": {"backup": "yes"}},
+			{"id": "dddddddd-4", "name": "data-old", "status": "available", "volume_type": "ssd", "metadata": {}},
+			{"id": "eeeeeeee-5", "name": "data-tmp", "status": "available", "volume_type": "ssd", "metadata": {"backup": "yes", "protect-ostack:temp": "true"}},
+			{"id": "ffffffff-6", "name": "data-used", "status": "in-use", "volume_type": "ssd", "metadata": {"backup": "yes"},
+			 "attachments": [{"server_id": "s1", "volume_id": "ffffffff-6"}]}
+		]}`))
+	}))
+	defer srv.Close()
+	client := &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: srv.URL + "/"}
+
+	cfg := &Config{VolumeFilter: "data*", VolumeMetadata: "backup:yes", VolumeTypes: []string{"ssd"}}
+	got, err := DiscoverDetachedVolumes(context.Background(), client, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two volumes named "data" get separate directories, the same as when only one of them exists.
+	want := []DetachedVolume{{Dir: "data-aaaaaaaa", ID: "aaaaaaaa-1"}, {Dir: "data-bbbbbbbb", ID: "bbbbbbbb-2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,369 @@
+package ostack
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/backups"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/v2/pagination"
+)
+
+// Volume backup methods (backup_method in config).
+const (
+	// BackupMethodGlanceExport snapshots the volume, copies it to a temporary volume, uploads that
+	// to Glance, and downloads the image into the backup target.
+	BackupMethodGlanceExport = "glance-export"
+	// BackupMethodCinderBackup uses the Cinder backup service; the data stays in the cloud's
+	// backup store and the run records the backup ID.
+	BackupMethodCinderBackup = "cinder-backup"
+)
+
+// CinderBackupConfig configures backup_method: cinder-backup.
+type CinderBackupConfig struct {
+	// Incremental makes each backup incremental against the previous available backup of the
+	// same volume; the first backup of a volume is always full.
+	Incremental bool `yaml:"incremental"`
+	// FullEvery takes a full backup instead once a volume has this many incremental backups on
+	// top of its last full one, so that prune can remove older chains; 0 = never.
+	FullEvery int `yaml:"full_every"`
+	// Container is the backup driver's container (e.g. Swift container or Ceph pool); empty = driver default.
+	Container string `yaml:"container"`
+}
+
+// CinderBackupSuffix names the record written for a cinder-backup volume: <volID>.cinder-backup.json.
+const CinderBackupSuffix = ".cinder-backup.json"
+
+// CinderBackupRecord is the content of <volID>.cinder-backup.json. Restore reads the backup ID from it.
+type CinderBackupRecord struct {
+	BackupID       string    `json:"backup_id"`
+	VolumeID       string    `json:"volume_id"`
+	SizeGB         int       `json:"size_gb"`
+	Incremental    bool      `json:"incremental"`
+	ParentBackupID string    `json:"parent_backup_id,omitempty"`
+	Container      string    `json:"container,omitempty"`
+	Region         string    `json:"region,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// ValidateBackupMethod checks backup_method in cfg.
+func ValidateBackupMethod(cfg *Config) error {
+	switch cfg.BackupMethod {
+	case "", BackupMethodGlanceExport, BackupMethodCinderBackup:
+		return nil
+	}
+	return fmt.Errorf("unsupported backup_method %q (supported: %s, %s)", cfg.BackupMethod, BackupMethodGlanceExport, BackupMethodCinderBackup)
+}
+
+// backupDetailOpts lists a volume's backups with details. ListDetailOpts has no volume filter,
+// but /backups/detail accepts the same filters as /backups.
+type backupDetailOpts struct {
+	VolumeID string `q:"volume_id"`
+	Sort     string `q:"sort"`
+}
+
+func (o backupDetailOpts) ToBackupListDetailQuery() (string, error) {
+	q, err := gophercloud.BuildQueryString(o)
+	if err != nil {
+		return "", err
+	}
+	return q.String(), nil
+}
+
+// latestCinderBackup returns the newest available backup of volID, or nil if it has none, and the
+// number of incremental backups newer than its newest full one. The newest backup is the one
+// Cinder bases an incremental backup on.
+func latestCinderBackup(ctx context.Context, blockClient *gophercloud.ServiceClient, volID string) (*backups.Backup, int, error) {
+	var latest, lastFull *backups.Backup
+	var avail []backups.Backup
+	err := backups.ListDetail(blockClient, backupDetailOpts{VolumeID: volID, Sort: "created_at:desc"}).EachPage(ctx,
+		func(_ context.Context, page pagination.Page) (bool, error) {
+			list, err := backups.ExtractBackups(page)
+			if err != nil {
+				return false, err
+			}
+			for i := range list {
+				b := &list[i]
+				if b.VolumeID != volID || b.Status != "available" {
+					continue
+				}
+				avail = append(avail, *b)
+				if latest == nil || b.CreatedAt.After(latest.CreatedAt) {
+					latest = b
+				}
+				if !b.IsIncremental && (lastFull == nil || b.CreatedAt.After(lastFull.CreatedAt)) {
+					lastFull = b
+				}
+			}
+			return true, nil
+		})
+	chain := 0
+	for _, b := range avail {
+		if b.IsIncremental && (lastFull == nil || b.CreatedAt.After(lastFull.CreatedAt)) {
+			chain++
+		}
+	}
+	return latest, chain, err
+}
+
+// BackupVolumeCinder backs up a volume with the Cinder backup service (incremental if configured and
+// the volume has a previous backup), waits for it to become available, and writes
+// <volID>.cinder-backup.json to dest. If snap is set, the backup is taken from that snapshot, which
+// is deleted afterwards unless it is a group snapshot member. Returns the manifest entry for the record.
+func BackupVolumeCinder(ctx context.Context, blockClient *gophercloud.ServiceClient, cfg *Config, att VolumeAttachment, dest Sink, vmName string, snap *takenSnapshot) (*Artifact, error) {
+	volID := att.VolumeID
+	prov := &VolumeProvenance{VolumeID: volID, Device: att.Device, StartedAt: time.Now().UTC()}
+	timestamp := time.Now().Format("2006-01-02_1504")
+	log.Printf("Backing up volume %s with Cinder backup", volID)
+
+	vol, err := volumes.Get(ctx, blockClient, volID).Extract()
+	if err != nil {
+		return nil, err
+	}
+	prov.SizeGB = vol.Size
+
+	var snapID string
+	if snap != nil {
+		snap.used = true
+		snapID = snap.ID
+		prov.GroupSnapshotID = snap.GroupSnapshotID
+		if snap.owned() {
+			defer func() {
+				if err := snapshots.Delete(ctx, blockClient, snapID).ExtractErr(); err != nil {
+					log.Printf("Warning: Failed to delete snapshot %s: %v", snapID, err)
+				} else {
+					log.Printf("Cleaned up snapshot: %s", snapID)
+				}
+			}()
+		}
+	}
+	opts := backups.CreateOpts{
+		VolumeID:    volID,
+		Name:        "protect-ostack-" + volID + "-" + timestamp,
+		Description: "protect-ostack backup of " + vmName,
+		Container:   cfg.CinderBackup.Container,
+		SnapshotID:  snapID,
+		// Attached volumes are in-use; the driver backs them up from a temporary snapshot.
+		Force: true,
+	}
+	prov.SnapshotID = snapID
+	if cfg.CinderBackup.Incremental {
+		parent, chain, err := latestCinderBackup(ctx, blockClient, volID)
+		if err != nil {
+			return nil, fmt.Errorf("list backups: %w", err)
+		}
+		switch {
+		case parent != nil && cfg.CinderBackup.FullEvery > 0 && chain >= cfg.CinderBackup.FullEvery:
+			log.Printf("%d incremental backups of %s since the last full one; taking a full backup", chain, volID)
+		case parent != nil:
+			opts.Incremental = true
+			prov.ParentBackupID = parent.ID
+			log.Printf("Incremental backup of %s on top of %s", volID, parent.ID)
+		default:
+			log.Printf("No previous backup of %s; taking a full backup", volID)
+		}
+	}
+
+	b, err := backups.Create(ctx, blockClient, opts).Extract()
+	if err != nil {
+		return nil, err
+	}
+	prov.BackupID = b.ID
+	prov.Incremental = opts.Incremental
+	log.Printf("Created Cinder backup %s of volume %s", b.ID, volID)
+
+	b, err = waitBackupAvailable(ctx, blockClient, cfg, b.ID)
+	if err != nil {
+		return nil, err
+	}
+	prov.FinishedAt = time.Now().UTC()
+
+	rec := CinderBackupRecord{
+		BackupID:       b.ID,
+		VolumeID:       volID,
+		SizeGB:         vol.Size,
+		Incremental:    b.IsIncremental,
+		ParentBackupID: prov.ParentBackupID,
+		Container:      b.Container,
+		Region:         cfg.Region,
+		CreatedAt:      b.CreatedAt,
+	}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	art, err := writeConfigArtifact(ctx, dest, volID+CinderBackupSuffix, data)
+	if err != nil {
+		return nil, fmt.Errorf("write backup record: %w", err)
+	}
+	art.Kind = ArtifactCinderBackup
+	art.Volume = prov
+	log.Printf("Volume %s backed up as Cinder backup %s", volID, b.ID)
+	return &art, nil
+}
+
+// waitBackupAvailable polls Cinder until the backup is available, using the status timeout/interval from config.
+// A backup that ends in error is deleted.
+func waitBackupAvailable(ctx context.Context, blockClient *gophercloud.ServiceClient, cfg *Config, backupID string) (*backups.Backup, error) {
+	timeout := time.Duration(cfg.StatusTimeoutSec) * time.Second
+	interval := time.Duration(cfg.StatusIntervalSec) * time.Second
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		ensureToken(ctx, blockClient)
+		b, err := backups.Get(ctx, blockClient, backupID).Extract()
+		if err != nil {
+			return nil, err
+		}
+		switch b.Status {
+		case "available":
+			log.Printf("Backup %s is available", backupID)
+			return b, nil
+		case "error":
+			if err := backups.Delete(ctx, blockClient, backupID).ExtractErr(); err != nil {
+				log.Printf("Warning: Failed to delete backup %s: %v", backupID, err)
+			}
+			return nil, fmt.Errorf("backup %s entered error state: %s", backupID, b.FailReason)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	return nil, fmt.Errorf("timeout waiting for backup %s", backupID)
+}
+
+// readCinderRecords returns the <volID>.cinder-backup.json records of the backup run in run.
+func readCinderRecords(ctx context.Context, run Sink) ([]CinderBackupRecord, error) {
+	objs, err := run.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var recs []CinderBackupRecord
+	for _, o := range objs {
+		if strings.Contains(o.Key, "/") || !strings.HasSuffix(o.Key, CinderBackupSuffix) {
+			continue
+		}
+		data, err := readObject(ctx, run, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		var rec CinderBackupRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", o.Key, err)
+		}
+		if rec.BackupID != "" {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+// keepCinderParents marks, in keep, the runs holding a Cinder backup that a kept run's
+// incremental backup depends on, directly or through other incremental backups. recs are the
+// records of each run. It returns how many runs it added.
+func keepCinderParents(recs [][]CinderBackupRecord, keep []bool) int {
+	parent := map[string]string{}
+	for _, rs := range recs {
+		for _, r := range rs {
+			parent[r.BackupID] = r.ParentBackupID
+		}
+	}
+	needed := map[string]bool{}
+	for i, rs := range recs {
+		if !keep[i] {
+			continue
+		}
+		for _, r := range rs {
+			for id := r.ParentBackupID; id != "" && !needed[id]; id = parent[id] {
+				needed[id] = true
+			}
+		}
+	}
+	added := 0
+	for i, rs := range recs {
+		if keep[i] {
+			continue
+		}
+		if slices.ContainsFunc(rs, func(r CinderBackupRecord) bool { return needed[r.BackupID] }) {
+			keep[i] = true
+			added++
+		}
+	}
+	return added
+}
+
+// deleteCinderBackup deletes a Cinder backup and waits until it is gone, so that its parent can be
+// deleted next (Cinder refuses to delete a backup while an incremental one depends on it).
+// A backup that no longer exists is not an error.
+func deleteCinderBackup(ctx context.Context, blockClient *gophercloud.ServiceClient, cfg *Config, backupID string) error {
+	err := backups.Delete(ctx, blockClient, backupID).ExtractErr()
+	if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(cfg.StatusTimeoutSec) * time.Second
+	interval := time.Duration(cfg.StatusIntervalSec) * time.Second
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		b, err := backups.Get(ctx, blockClient, backupID).Extract()
+		if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			log.Printf("Deleted Cinder backup %s", backupID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if b.Status == "error_deleting" {
+			return fmt.Errorf("backup %s entered error_deleting state: %s", backupID, b.FailReason)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	return fmt.Errorf("timeout waiting for backup %s to be deleted", backupID)
+}
+
+// restoreCinderBackup restores the backup recorded in vf (a <volID>.cinder-backup.json record)
+// to a new volume named name and waits for it to become available. Returns the new volume ID, also
+// with the error if the volume was created but did not become available.
+func restoreCinderBackup(ctx context.Context, blockClient *gophercloud.ServiceClient, cfg *Config, src Sink, vf backupVolumeFile, name string) (string, error) {
+	var rec CinderBackupRecord
+	data, err := readObject(ctx, src, vf.Key)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return "", fmt.Errorf("parse %s: %w", vf.Key, err)
+	}
+	if rec.BackupID == "" {
+		return "", fmt.Errorf("%s: no backup_id", vf.Key)
+	}
+	if rec.Region != "" && cfg.Region != "" && !strings.EqualFold(rec.Region, cfg.Region) {
+		log.Printf("Warning: backup %s was taken in region %s; restoring in %s", rec.BackupID, rec.Region, cfg.Region)
+	}
+	log.Printf("Restoring Cinder backup %s to volume %s", rec.BackupID, name)
+	res, err := backups.RestoreFromBackup(ctx, blockClient, rec.BackupID, backups.RestoreOpts{Name: name}).Extract()
+	if err != nil {
+		return "", fmt.Errorf("restore backup %s: %w", rec.BackupID, err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.StatusTimeoutSec)*time.Second)
+	defer cancel()
+	if err := volumes.WaitForStatus(waitCtx, blockClient, res.VolumeID, "available"); err != nil {
+		return res.VolumeID, fmt.Errorf("volume %s: %w", res.VolumeID, err)
+	}
+	log.Printf("Volume %s is available", res.VolumeID)
+	return res.VolumeID, nil
+}
@@ -0,0 +1,71 @@
+package ostack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2"
+)
+
+// fakeBackupList serves /backups/detail with backups, a JSON list body.
+func fakeBackupList(t *testing.T, backups string) *gophercloud.ServiceClient {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/backups/detail" || r.URL.Query().Get("volume_id") != "vol1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"backups": [%s]}`, backups)
+	}))
+	t.Cleanup(srv.Close)
+	return &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: srv.URL + "/"}
+}
+
+func backupJSON(id, volID, status string, incremental bool, created string) string {
+	return fmt.Sprintf(`{"id": %q, "volume_id": %q, "status": %q, "is_incremental": %t, "created_at": "2026-10-%sT00:00:00.000000"}`,
+		id, volID, status, incremental, created)
+}
+
+func TestLatestCinderBackup(t *testing.T) {
+	tests := []struct {
+		name       string
+		backups    []string
+		wantLatest string
+		wantChain  int
+	}{
+		{"no backups", nil, "", 0},
+		{"full only", []string{backupJSON("b1", "vol1", "available", false, "01")}, "b1", 0},
+		{"chain on the last full", []string{
+			backupJSON("b5", "vol1", "error", true, "05"),
+			backupJSON("b4", "vol1", "available", true, "04"),
+			backupJSON("b3", "vol1", "available", true, "03"),
+			backupJSON("b2", "vol1", "available", false, "02"),
+			backupJSON("b1", "vol1", "available", true, "01"),
+			backupJSON("x9", "vol2", "available", true, "09"),
+		}, "b4", 2},
+		{"incrementals without a full", []string{
+			backupJSON("b2", "vol1", "available", true, "02"),
+			backupJSON("b1", "vol1", "available", true, "01"),
+		}, "b2", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fakeBackupList(t, strings.Join(tt.backups, ","))
+			latest, chain, err := latestCinderBackup(context.Background(), client, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if latest != nil {
+				got = latest.ID
+			}
+			if got != tt.wantLatest || chain != tt.wantChain {
+				t.Errorf("latest %q with %d incrementals since the last full, want %q and %d", got, chain, tt.wantLatest, tt.wantChain)
+			}
+		})
+	}
+}
@@ -2,23 +2,210 @@ package ostack
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gophercloud/gophercloud/v2"
 	"github.com/gophercloud/gophercloud/v2/openstack"
 )
 
+// Keystone authentication types (auth_type in config).
+const (
+	AuthTypePassword              = "password"
+	AuthTypeApplicationCredential = "application_credential"
+	AuthTypeToken                 = "token"
+)
+
+// AuthConfig holds the Keystone (v3) endpoint and credentials.
+type AuthConfig struct {
+	KeystoneURL string `yaml:"keystone_url"`
+	// AuthType is password (default), application_credential, or token.
+	AuthType string `yaml:"auth_type"`
+	// Project (or ProjectID) is the project to scope to; application credentials carry their own.
+	Project   string `yaml:"project"`
+	ProjectID string `yaml:"project_id"`
+	// User (or UserID) and Password for auth_type: password. User or UserID also identifies the
+	// owner of an application credential given by name.
+	User     string `yaml:"user"`
+	UserID   string `yaml:"user_id"`
+	Password string `yaml:"password"`
+	// PasswordFile, PasswordEnv (a variable name), or PasswordCommand (run with sh -c; its output is
+	// the password) supply the password when Password is empty, so it need not be in this file.
+	PasswordFile    string `yaml:"password_file"`
+	PasswordEnv     string `yaml:"password_env"`
+	PasswordCommand string `yaml:"password_command"`
+	// Domain is the default for the user's and the project's domain.
+	Domain string `yaml:"domain"`
+	// UserDomain / UserDomainID and ProjectDomain / ProjectDomainID override Domain (IDs take precedence).
+	UserDomain      string `yaml:"user_domain"`
+	UserDomainID    string `yaml:"user_domain_id"`
+	ProjectDomain   string `yaml:"project_domain"`
+	ProjectDomainID string `yaml:"project_domain_id"`
+	// ApplicationCredentialID (or ApplicationCredentialName with User/UserID) and
+	// ApplicationCredentialSecret for auth_type: application_credential.
+	ApplicationCredentialID     string `yaml:"application_credential_id"`
+	ApplicationCredentialName   string `yaml:"application_credential_name"`
+	ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+	// Token is an existing Keystone token for auth_type: token.
+	Token string `yaml:"token"`
+}
+
+// ValidateAuth checks that cfg has the credentials its auth_type needs.
+func ValidateAuth(cfg *Config) error {
+	a := cfg.AuthConfig
+	var missing []string
+	need := func(ok bool, what string) {
+		if !ok {
+			missing = append(missing, what)
+		}
+	}
+	need(a.KeystoneURL != "", "keystone_url")
+	switch a.AuthType {
+	case "", AuthTypePassword:
+		need(a.User != "" || a.UserID != "", "user (or user_id)")
+		need(a.Password != "" || a.hasPasswordSource(), "password (or password_file, password_env, password_command)")
+		need(a.Project != "" || a.ProjectID != "" || len(cfg.Projects) > 0, "project (or project_id)")
+	case AuthTypeApplicationCredential:
+		need(a.ApplicationCredentialID != "" || a.ApplicationCredentialName != "", "application_credential_id (or application_credential_name)")
+		if a.ApplicationCredentialID == "" && a.ApplicationCredentialName != "" {
+			need(a.User != "" || a.UserID != "", "user (or user_id)")
+		}
+		need(a.ApplicationCredentialSecret != "", "application_credential_secret")
+	case AuthTypeToken:
+		need(a.Token != "", "token")
+		need(a.Project != "" || a.ProjectID != "" || len(cfg.Projects) > 0, "project (or project_id)")
+	default:
+		return fmt.Errorf("unsupported auth_type %q (supported: %s, %s, %s)", a.AuthType, AuthTypePassword, AuthTypeApplicationCredential, AuthTypeToken)
+	}
+	switch endpointInterface(cfg.Interface) {
+	case "", gophercloud.AvailabilityPublic, gophercloud.AvailabilityInternal, gophercloud.AvailabilityAdmin:
+	default:
+		return fmt.Errorf("unsupported interface %q (supported: public, internal, admin)", cfg.Interface)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// userDomain returns the user's domain ID or name.
+func (a AuthConfig) userDomain() (id, name string) {
+	if a.UserDomainID != "" {
+		return a.UserDomainID, ""
+	}
+	if a.UserDomain != "" {
+		return "", a.UserDomain
+	}
+	return "", a.Domain
+}
+
+// projectScope returns the project scope for password and token auth; nil (an unscoped token)
+// without a project, as used to list the projects of a multi-project run.
+func (a AuthConfig) projectScope() *gophercloud.AuthScope {
+	if a.Project == "" && a.ProjectID == "" {
+		return nil
+	}
+	if a.ProjectID != "" {
+		return &gophercloud.AuthScope{ProjectID: a.ProjectID}
+	}
+	scope := &gophercloud.AuthScope{ProjectName: a.Project}
+	switch {
+	case a.ProjectDomainID != "":
+		scope.DomainID = a.ProjectDomainID
+	case a.ProjectDomain != "":
+		scope.DomainName = a.ProjectDomain
+	default:
+		scope.DomainName = a.Domain
+	}
+	return scope
+}
+
+// authOptions builds the Gophercloud auth options for cfg's auth_type.
+func authOptions(cfg *Config) (gophercloud.AuthOptions, error) {
+	a := cfg.AuthConfig
+	// AllowReauth keeps the credentials in memory so that an expired token is replaced on a 401.
+	opts := gophercloud.AuthOptions{IdentityEndpoint: a.KeystoneURL, AllowReauth: true}
+	// A user ID identifies the user on its own; a user name needs its domain.
+	setUser := func() {
+		if a.UserID != "" {
+			opts.UserID = a.UserID
+			return
+		}
+		opts.Username = a.User
+		opts.DomainID, opts.DomainName = a.userDomain()
+	}
+	switch a.AuthType {
+	case "", AuthTypePassword:
+		setUser()
+		opts.Password = a.Password
+		opts.Scope = a.projectScope()
+	case AuthTypeApplicationCredential:
+		// The application credential determines the project; the request must not carry a scope.
+		opts.ApplicationCredentialID = a.ApplicationCredentialID
+		opts.ApplicationCredentialSecret = a.ApplicationCredentialSecret
+		if a.ApplicationCredentialID == "" {
+			opts.ApplicationCredentialName = a.ApplicationCredentialName
+			setUser()
+		}
+	case AuthTypeToken:
+		// A token cannot be renewed with itself once it has expired.
+		opts.AllowReauth = false
+		opts.TokenID = a.Token
+		opts.Scope = a.projectScope()
+	default:
+		return opts, fmt.Errorf("unsupported auth_type %q", a.AuthType)
+	}
+	return opts, nil
+}
+
+// endpointInterface maps an interface setting (public, internalURL, ...) to a catalog availability.
+func endpointInterface(v string) gophercloud.Availability {
+	return gophercloud.Availability(strings.TrimSuffix(strings.ToLower(v), "url"))
+}
+
+// endpointOpts selects the catalog endpoints of region on cfg's interface (default public).
+func endpointOpts(cfg *Config, region string) gophercloud.EndpointOpts {
+	return gophercloud.EndpointOpts{Region: region, Availability: endpointInterface(cfg.Interface)}
+}
+
+// newHTTPClient returns the HTTP client for the OpenStack APIs, using cfg.TLS. All service clients
+// share it, so image downloads and Swift transfers use the same TLS settings and timeouts as
+// Keystone. It sets no overall Client.Timeout, which would cut off long image downloads.
+func newHTTPClient(cfg *Config) (http.Client, error) {
+	tr, err := cfg.TLS.Transport()
+	if err != nil {
+		return http.Client{}, err
+	}
+	return http.Client{Transport: tr}, nil
+}
+
 // NewProvider authenticates with Keystone (v3) and returns a Gophercloud ProviderClient.
-// Endpoints for Compute, Block Storage, and Image are discovered from the catalog using cfg.Region.
+// Endpoints for Compute, Block Storage, and Image are discovered from the catalog using cfg.Region
+// and cfg.Interface. Except with auth_type: token, the client re-authenticates when its token expires.
 func NewProvider(ctx context.Context, cfg *Config) (*gophercloud.ProviderClient, error) {
-	opts := gophercloud.AuthOptions{
-		IdentityEndpoint: cfg.KeystoneURL,
-		Username:         cfg.User,
-		Password:         cfg.Password,
-		DomainName:       cfg.Domain,
-		Scope: &gophercloud.AuthScope{
-			ProjectName: cfg.Project,
-			DomainName:  cfg.Domain,
-		},
-	}
-	return openstack.AuthenticatedClient(ctx, opts)
+	if err := resolvePassword(ctx, cfg); err != nil {
+		return nil, err
+	}
+	opts, err := authOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := openstack.NewClient(opts.IdentityEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	if provider.HTTPClient, err = newHTTPClient(cfg); err != nil {
+		return nil, err
+	}
+	if err := openstack.Authenticate(ctx, provider, opts); err != nil {
+		return nil, err
+	}
+	logReauth(provider)
+	if exp := tokenExpiry(provider); provider.ReauthFunc == nil && !exp.IsZero() {
+		log.Printf("Keystone token expires %s and cannot be renewed (auth_type: %s)", exp.Format(time.RFC3339), cfg.AuthType)
+	}
+	return provider, nil
 }
@@ -0,0 +1,201 @@
+package ostack
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// cloudsFile is a clouds.yaml (or secure.yaml) file as used by the OpenStack CLI and SDKs.
+type cloudsFile struct {
+	Clouds map[string]cloudEntry `yaml:"clouds"`
+}
+
+// cloudEntry is one cloud of a clouds.yaml file; only the keys this tool uses are read.
+type cloudEntry struct {
+	AuthType   string `yaml:"auth_type"`
+	RegionName string `yaml:"region_name"`
+	Interface  string `yaml:"interface"`
+	CACert     string `yaml:"cacert"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	Verify     *bool  `yaml:"verify"`
+	Auth       struct {
+		AuthURL                     string `yaml:"auth_url"`
+		Username                    string `yaml:"username"`
+		UserID                      string `yaml:"user_id"`
+		Password                    string `yaml:"password"`
+		ProjectName                 string `yaml:"project_name"`
+		ProjectID                   string `yaml:"project_id"`
+		DomainName                  string `yaml:"domain_name"`
+		UserDomainName              string `yaml:"user_domain_name"`
+		UserDomainID                string `yaml:"user_domain_id"`
+		ProjectDomainName           string `yaml:"project_domain_name"`
+		ProjectDomainID             string `yaml:"project_domain_id"`
+		ApplicationCredentialID     string `yaml:"application_credential_id"`
+		ApplicationCredentialName   string `yaml:"application_credential_name"`
+		ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+		Token                       string `yaml:"token"`
+	} `yaml:"auth"`
+}
+
+// cloudsSearchPath returns the directories searched for clouds.yaml and secure.yaml,
+// in the OpenStack client's order.
+func cloudsSearchPath() []string {
+	dirs := []string{"."}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".config", "openstack"))
+	}
+	return append(dirs, "/etc/openstack")
+}
+
+// findCloudsFile returns the first name (clouds.yaml or secure.yaml) in the search path, or "".
+// OS_CLIENT_CONFIG_FILE / OS_CLIENT_SECURE_FILE name the file directly.
+func findCloudsFile(name, envVar string) string {
+	if p := os.Getenv(envVar); p != "" {
+		return p
+	}
+	for _, dir := range cloudsSearchPath() {
+		p := filepath.Join(dir, name)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// loadCloudEntry reads cloud from clouds.yaml, with secrets from secure.yaml if present.
+func loadCloudEntry(cloud string) (*cloudEntry, error) {
+	path := findCloudsFile("clouds.yaml", "OS_CLIENT_CONFIG_FILE")
+	if path == "" {
+		return nil, fmt.Errorf("cloud %q: no clouds.yaml found (searched %v)", cloud, cloudsSearchPath())
+	}
+	var f cloudsFile
+	if err := readYAML(path, &f); err != nil {
+		return nil, err
+	}
+	entry, ok := f.Clouds[cloud]
+	if !ok {
+		return nil, fmt.Errorf("cloud %q not found in %s", cloud, path)
+	}
+	if secure := findCloudsFile("secure.yaml", "OS_CLIENT_SECURE_FILE"); secure != "" {
+		var s cloudsFile
+		if err := readYAML(secure, &s); err != nil {
+			return nil, err
+		}
+		// secure.yaml usually only holds secrets; its values replace the ones in clouds.yaml.
+		if e, ok := s.Clouds[cloud]; ok {
+			overlay(&entry.Auth.Password, e.Auth.Password)
+			overlay(&entry.Auth.ApplicationCredentialSecret, e.Auth.ApplicationCredentialSecret)
+			overlay(&entry.Auth.Token, e.Auth.Token)
+		}
+	}
+	return &entry, nil
+}
+
+func readYAML(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// overlay sets *dst to v if v is not empty.
+func overlay(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+// overlayPair sets a name/ID pair (user, project, domain, ...) if either is set: a source that
+// names the project replaces a project ID from a lower-precedence source, and vice versa.
+func overlayPair(dstName, dstID *string, name, id string) {
+	if name != "" || id != "" {
+		*dstName, *dstID = name, id
+	}
+}
+
+// cloudAuthType maps an OpenStack client auth type (v3password, v3applicationcredential, ...)
+// to auth_type.
+func cloudAuthType(t string) string {
+	switch t {
+	case "password", "v3password":
+		return AuthTypePassword
+	case "v3applicationcredential", "application_credential":
+		return AuthTypeApplicationCredential
+	case "token", "v3token":
+		return AuthTypeToken
+	}
+	return t
+}
+
+// ApplyCloud overlays the settings of cloud from clouds.yaml (and secure.yaml) onto cfg.
+// Keys the cloud does not set keep their config file values.
+func ApplyCloud(cfg *Config, cloud string) error {
+	e, err := loadCloudEntry(cloud)
+	if err != nil {
+		return err
+	}
+	a := e.Auth
+	overlay(&cfg.KeystoneURL, a.AuthURL)
+	if e.AuthType != "" {
+		cfg.AuthType = cloudAuthType(e.AuthType)
+	}
+	overlayPair(&cfg.User, &cfg.UserID, a.Username, a.UserID)
+	overlay(&cfg.Password, a.Password)
+	overlayPair(&cfg.Project, &cfg.ProjectID, a.ProjectName, a.ProjectID)
+	overlay(&cfg.Domain, a.DomainName)
+	overlayPair(&cfg.UserDomain, &cfg.UserDomainID, a.UserDomainName, a.UserDomainID)
+	overlayPair(&cfg.ProjectDomain, &cfg.ProjectDomainID, a.ProjectDomainName, a.ProjectDomainID)
+	overlayPair(&cfg.ApplicationCredentialName, &cfg.ApplicationCredentialID, a.ApplicationCredentialName, a.ApplicationCredentialID)
+	overlay(&cfg.ApplicationCredentialSecret, a.ApplicationCredentialSecret)
+	overlay(&cfg.Token, a.Token)
+	overlay(&cfg.Region, e.RegionName)
+	overlay(&cfg.Interface, e.Interface)
+	overlay(&cfg.TLS.CAFile, e.CACert)
+	overlay(&cfg.TLS.CertFile, e.Cert)
+	overlay(&cfg.TLS.KeyFile, e.Key)
+	if e.Verify != nil {
+		cfg.TLS.InsecureSkipVerify = !*e.Verify
+	}
+	return nil
+}
+
+// ApplyEnv overlays the OS_* environment variables of an OpenStack RC file onto cfg.
+// Unset variables keep the current values.
+func ApplyEnv(cfg *Config) {
+	get := func(names ...string) string {
+		for _, n := range names {
+			if v := os.Getenv(n); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	env := func(dst *string, names ...string) {
+		overlay(dst, get(names...))
+	}
+	env(&cfg.KeystoneURL, "OS_AUTH_URL")
+	if t := os.Getenv("OS_AUTH_TYPE"); t != "" {
+		cfg.AuthType = cloudAuthType(t)
+	}
+	overlayPair(&cfg.User, &cfg.UserID, get("OS_USERNAME"), get("OS_USER_ID"))
+	env(&cfg.Password, "OS_PASSWORD")
+	overlayPair(&cfg.Project, &cfg.ProjectID, get("OS_PROJECT_NAME", "OS_TENANT_NAME"), get("OS_PROJECT_ID", "OS_TENANT_ID"))
+	overlayPair(&cfg.UserDomain, &cfg.UserDomainID, get("OS_USER_DOMAIN_NAME"), get("OS_USER_DOMAIN_ID"))
+	overlayPair(&cfg.ProjectDomain, &cfg.ProjectDomainID, get("OS_PROJECT_DOMAIN_NAME"), get("OS_PROJECT_DOMAIN_ID"))
+	overlayPair(&cfg.ApplicationCredentialName, &cfg.ApplicationCredentialID, get("OS_APPLICATION_CREDENTIAL_NAME"), get("OS_APPLICATION_CREDENTIAL_ID"))
+	env(&cfg.ApplicationCredentialSecret, "OS_APPLICATION_CREDENTIAL_SECRET")
+	env(&cfg.Token, "OS_TOKEN")
+	env(&cfg.Region, "OS_REGION_NAME")
+	env(&cfg.Interface, "OS_INTERFACE")
+	env(&cfg.TLS.CAFile, "OS_CACERT")
+	env(&cfg.TLS.CertFile, "OS_CERT")
+	env(&cfg.TLS.KeyFile, "OS_KEY")
+}
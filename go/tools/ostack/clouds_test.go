@@ -0,0 +1,137 @@
+package ostack
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// osEnv lists the OS_* variables ApplyEnv reads, cleared by clearOSEnv.
+var osEnv = []string{
+	"OS_AUTH_URL", "OS_AUTH_TYPE", "OS_USERNAME", "OS_USER_ID", "OS_PASSWORD",
+	"OS_PROJECT_NAME", "OS_TENANT_NAME", "OS_PROJECT_ID", "OS_TENANT_ID",
+	"OS_USER_DOMAIN_NAME", "OS_USER_DOMAIN_ID", "OS_PROJECT_DOMAIN_NAME", "OS_PROJECT_DOMAIN_ID",
+	"OS_APPLICATION_CREDENTIAL_NAME", "OS_APPLICATION_CREDENTIAL_ID", "OS_APPLICATION_CREDENTIAL_SECRET",
+	"OS_TOKEN", "OS_REGION_NAME", "OS_INTERFACE", "OS_CACERT", "OS_CERT", "OS_KEY",
+}
+
+func clearOSEnv(t *testing.T) {
+	for _, n := range osEnv {
+		t.Setenv(n, "")
+	}
+}
+
+// writeCloudsFiles writes clouds.yaml and secure.yaml and points OS_CLIENT_*_FILE at them.
+func writeCloudsFiles(t *testing.T, clouds, secure string) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{"clouds.yaml": clouds, "secure.yaml": secure} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("OS_CLIENT_CONFIG_FILE", filepath.Join(dir, "clouds.yaml"))
+	t.Setenv("OS_CLIENT_SECURE_FILE", filepath.Join(dir, "secure.yaml"))
+}
+
+const testClouds = `
+clouds:
+  prod:
+    auth_type: v3applicationcredential
+    region_name: RegionTwo
+    interface: internal
+    cacert: /etc/ssl/prod-ca.pem
+    verify: false
+    auth:
+      auth_url: https://keystone.prod:5000/v3
+      application_credential_id: ac-1
+      application_credential_secret: from-clouds
+      project_id: p-1
+  lab:
+    auth:
+      auth_url: https://keystone.lab:5000/v3
+`
+
+func TestApplyCloud(t *testing.T) {
+	clearOSEnv(t)
+	writeCloudsFiles(t, testClouds, "clouds:\n  prod:\n    auth:\n      application_credential_secret: from-secure\n")
+	cfg := &Config{}
+	cfg.KeystoneURL = "https://keystone.file:5000/v3"
+	cfg.AuthType = AuthTypePassword
+	cfg.Project, cfg.User, cfg.Domain = "file-project", "file-user", "Default"
+	if err := ApplyCloud(cfg, "prod"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ name, got, want string }{
+		{"keystone_url", cfg.KeystoneURL, "https://keystone.prod:5000/v3"},
+		{"auth_type", cfg.AuthType, AuthTypeApplicationCredential},
+		{"application_credential_id", cfg.ApplicationCredentialID, "ac-1"},
+		{"application_credential_secret", cfg.ApplicationCredentialSecret, "from-secure"},
+		// The cloud's project ID replaces the file's project name.
+		{"project", cfg.Project, ""},
+		{"project_id", cfg.ProjectID, "p-1"},
+		// Keys the cloud does not set keep their file values.
+		{"user", cfg.User, "file-user"},
+		{"domain", cfg.Domain, "Default"},
+		{"region", cfg.Region, "RegionTwo"},
+		{"interface", cfg.Interface, "internal"},
+		{"tls.ca_file", cfg.TLS.CAFile, "/etc/ssl/prod-ca.pem"},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %q, want %q", c.name, c.got, c.want)
+		}
+	}
+	if !cfg.TLS.InsecureSkipVerify {
+		t.Error("verify: false did not set tls.insecure_skip_verify")
+	}
+
+	if err := ApplyCloud(&Config{}, "staging"); err == nil || !strings.Contains(err.Error(), `"staging" not found`) {
+		t.Errorf("unknown cloud: err = %v", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	clearOSEnv(t)
+	writeCloudsFiles(t, testClouds, "")
+	cfg := &Config{}
+	if err := ApplyCloud(cfg, "prod"); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OS_AUTH_TYPE", "password")
+	t.Setenv("OS_USERNAME", "admin")
+	t.Setenv("OS_PASSWORD", "secret")
+	t.Setenv("OS_TENANT_NAME", "ops")
+	t.Setenv("OS_REGION_NAME", "RegionOne")
+	ApplyEnv(cfg)
+	for _, c := range []struct{ name, got, want string }{
+		// OS_* variables override the cloud.
+		{"auth_type", cfg.AuthType, AuthTypePassword},
+		{"user", cfg.User, "admin"},
+		{"password", cfg.Password, "secret"},
+		{"project", cfg.Project, "ops"},
+		{"project_id", cfg.ProjectID, ""},
+		{"region", cfg.Region, "RegionOne"},
+		// Unset variables keep the cloud's values.
+		{"keystone_url", cfg.KeystoneURL, "https://keystone.prod:5000/v3"},
+		{"interface", cfg.Interface, "internal"},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %q, want %q", c.name, c.got, c.want)
+		}
+	}
+}
+
+func TestCloudAuthType(t *testing.T) {
+	for in, want := range map[string]string{
+		"password":                AuthTypePassword,
+		"v3password":              AuthTypePassword,
+		"v3applicationcredential": AuthTypeApplicationCredential,
+		"application_credential":  AuthTypeApplicationCredential,
+		"v3token":                 AuthTypeToken,
+		"v3oidcpassword":          "v3oidcpassword",
+	} {
+		if got := cloudAuthType(in); got != want {
+			t.Errorf("cloudAuthType(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package ostack
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// Compression codecs for volume images (compression in config).
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// compressionSuffixes maps each codec to the suffix appended to compressed image names.
+var compressionSuffixes = map[string]string{
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+// ValidateCompression checks the compression settings in cfg.
+func ValidateCompression(cfg *Config) error {
+	switch cfg.Compression {
+	case "", CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("unsupported compression %q (supported: none, gzip, zstd)", cfg.Compression)
+	}
+	if cfg.Compression == CompressionGzip && (cfg.CompressionLevel < 0 || cfg.CompressionLevel > 9) {
+		return fmt.Errorf("gzip compression_level must be 1-9 (0 = default)")
+	}
+	if cfg.Compression == CompressionZstd && (cfg.CompressionLevel < 0 || cfg.CompressionLevel > 22) {
+		return fmt.Errorf("zstd compression_level must be 1-22 (0 = default)")
+	}
+	return nil
+}
+
+// compressionCodec returns the configured codec, or "" for none.
+func compressionCodec(cfg *Config) string {
+	if cfg.Compression == CompressionNone {
+		return ""
+	}
+	return cfg.Compression
+}
+
+// splitCompression splits a stored file name into the uncompressed name and its codec ("" if not compressed),
+// e.g. "vol.qcow2.zst" -> ("vol.qcow2", "zstd").
+func splitCompression(name string) (string, string) {
+	for codec, suffix := range compressionSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), codec
+		}
+	}
+	return name, ""
+}
+
+func compressionWorkers(cfg *Config) int {
+	if cfg.CompressionWorkers > 0 {
+		return cfg.CompressionWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// newCompressWriter compresses into w with the configured codec, level, and worker count.
+// Close flushes the compressor but does not close w.
+func newCompressWriter(w io.Writer, cfg *Config) (io.WriteCloser, error) {
+	switch compressionCodec(cfg) {
+	case CompressionGzip:
+		level := cfg.CompressionLevel
+		if level == 0 {
+			level = pgzip.DefaultCompression
+		}
+		zw, err := pgzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		if err := zw.SetConcurrency(1<<20, compressionWorkers(cfg)); err != nil {
+			return nil, err
+		}
+		return zw, nil
+	case CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(compressionWorkers(cfg))}
+		if cfg.CompressionLevel > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(cfg.CompressionLevel)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	return nil, fmt.Errorf("compression %q: no compressor", cfg.Compression)
+}
+
+// newDecompressReader decompresses r encoded with codec; codec "" returns r unchanged.
+// Close releases the decompressor but does not close r.
+func newDecompressReader(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case "":
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		return pgzip.NewReader(r)
+	case CompressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", codec)
+}
+
+// decompressingReadCloser closes both the decompressor and the underlying object.
+type decompressingReadCloser struct {
+	io.ReadCloser
+	src io.Closer
+}
+
+func (r *decompressingReadCloser) Close() error {
+	r.ReadCloser.Close()
+	return r.src.Close()
+}
+
+// openDecompressed wraps rc, the contents of key, with the decompressor its name suffix selects.
+func openDecompressed(rc io.ReadCloser, key string) (io.ReadCloser, error) {
+	_, codec := splitCompression(key)
+	if codec == "" {
+		return rc, nil
+	}
+	dr, err := newDecompressReader(rc, codec)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return &decompressingReadCloser{ReadCloser: dr, src: rc}, nil
+}
@@ -3,37 +3,109 @@ package ostack
 const (
 	DefaultConfigDir  = "cfg"
 	DefaultConfigPath = "cfg/config.yaml"
+	// BackupTimeFormat names the per-run directories under BACKUP_DIR/VM.
+	BackupTimeFormat = "2006-01-02_15-04"
 )
 
 var (
-	SupportedDiskFormats   = map[string]bool{"qcow2": true, "raw": true, "vmdk": true, "vdi": true}
+	SupportedDiskFormats    = map[string]bool{"qcow2": true, "raw": true, "vmdk": true, "vdi": true}
 	BackupSupportedStatuses = map[string]bool{"ACTIVE": true, "SHUTOFF": true, "PAUSED": true, "SUSPENDED": true}
 )
 
 // Config holds OpenStack auth and backup options.
 // Loaded from YAML (default: cfg/config.yaml); CLI flags override.
 type Config struct {
-	KeystoneURL string `yaml:"keystone_url"`
-	CinderURL   string `yaml:"cinder_url"`   // unused with Gophercloud
-	NovaURL     string `yaml:"nova_url"`
-	GlanceURL   string `yaml:"glance_url"`
-	Project     string `yaml:"project"`
-	User        string `yaml:"user"`
-	Password    string `yaml:"password"`
-	Domain      string `yaml:"domain"`
-	Region      string `yaml:"region"`
-	BackupDir   string `yaml:"backup_dir"`
-	DiskFormat  string `yaml:"disk_format"`
-	DiscoverAll bool   `yaml:"discover_all"`
-	VMFilter    string `yaml:"vm_filter"`
-	VMTags      string `yaml:"vm_tags"`
+	// AuthConfig holds keystone_url and the credentials (auth_type, user, password, ...).
+	AuthConfig `yaml:",inline"`
+	CinderURL  string `yaml:"cinder_url"` // unused with Gophercloud
+	NovaURL    string `yaml:"nova_url"`
+	GlanceURL  string `yaml:"glance_url"`
+	Region     string `yaml:"region"`
+	// Interface is the catalog endpoint interface: public (default), internal, or admin.
+	Interface string `yaml:"interface"`
+	// TLS holds the CA bundle, client certificate, and verification settings for all HTTPS connections.
+	TLS       TLSConfig `yaml:"tls"`
+	BackupDir string    `yaml:"backup_dir"`
+	// BackupTarget is where artifacts are stored (file:///..., s3://..., swift://...); empty = BackupDir.
+	BackupTarget string `yaml:"backup_target"`
+	DiskFormat   string `yaml:"disk_format"`
+	// BackupMethod is how volumes are backed up: glance-export (default) or cinder-backup.
+	BackupMethod string `yaml:"backup_method"`
+	// CinderBackup configures backup_method: cinder-backup.
+	CinderBackup CinderBackupConfig `yaml:"cinder_backup"`
+	// SkipEphemeralRoot disables the backup of image-booted servers' ephemeral root disks (Nova createImage).
+	SkipEphemeralRoot bool `yaml:"skip_ephemeral_root"`
+	// Projects backs up each listed project (name or ID; "*" = every accessible project) with its own
+	// project-scoped token into <target>/<project>/; empty = the project of the credentials.
+	Projects []string `yaml:"projects"`
+	// ProjectRole skips projects where the user does not have this role (e.g. backup).
+	ProjectRole string   `yaml:"project_role"`
+	DiscoverAll bool     `yaml:"discover_all"`
+	VMFilter    string   `yaml:"vm_filter"`
+	VMTags      string   `yaml:"vm_tags"`
 	VMList      []string `yaml:"vm_list"`
-	MaxParallelSnapShots int `yaml:"max_parallel_snap_shots"`
-	MaxParallelVolumes   int `yaml:"max_parallel_volumes"`
+	// DiscoverVolumes selects the volumes to back up: attached (default; the selected VMs' volumes),
+	// all (also unattached volumes), or unattached (only unattached volumes, no VMs).
+	DiscoverVolumes string `yaml:"discover_volumes"`
+	// VolumeFilter, VolumeMetadata (key:value,...), and VolumeTypes select unattached volumes.
+	VolumeFilter         string   `yaml:"volume_filter"`
+	VolumeMetadata       string   `yaml:"volume_metadata"`
+	VolumeTypes          []string `yaml:"volume_types"`
+	MaxParallelSnapShots int      `yaml:"max_parallel_snap_shots"`
+	MaxParallelVolumes   int      `yaml:"max_parallel_volumes"`
 	// StatusTimeoutSec is max wait (seconds) for snapshot/volume/image to reach target status.
 	StatusTimeoutSec int `yaml:"status_timeout_sec"`
 	// StatusIntervalSec is poll interval (seconds) while waiting.
 	StatusIntervalSec int `yaml:"status_interval_sec"`
+	// RetentionPolicy holds the global keep_last/keep_daily/keep_weekly/keep_monthly keys.
+	RetentionPolicy `yaml:",inline"`
+	// RetentionOverrides replaces the global retention policy for the named VMs.
+	RetentionOverrides map[string]RetentionPolicy `yaml:"retention_overrides"`
+	// GroupSnapshots snapshots all volumes of a VM at once with a Cinder group snapshot (crash-consistent
+	// across disks) instead of one by one.
+	GroupSnapshots bool `yaml:"group_snapshots"`
+	// GroupType is the Cinder group type (name or ID) of the temporary volume group for group snapshots.
+	GroupType string `yaml:"group_type"`
+	// Quiesce freezes guests for filesystem-consistent snapshots; the server metadata
+	// protect-ostack:quiesce=true|false overrides it per VM.
+	Quiesce bool `yaml:"quiesce"`
+	// FreezeCommand and ThawCommand are run with sh -c around the volume snapshots of a quiesced VM.
+	FreezeCommand string `yaml:"freeze_command"`
+	ThawCommand   string `yaml:"thaw_command"`
+	// QuiesceTimeoutSec bounds each freeze/thaw command; 0 = 60.
+	QuiesceTimeoutSec int `yaml:"quiesce_timeout_sec"`
+	// Hooks are commands run before and after the run and each VM backup.
+	Hooks HooksConfig `yaml:"hooks"`
+	// SnapshotRetention keeps the snapshot of each backed-up volume in the cloud, tagged with
+	// protect-ostack:run-id, and prunes all but the newest N per volume; 0 = delete it after the backup.
+	SnapshotRetention int `yaml:"snapshot_retention"`
+	// PruneAfterRun applies retention to the backed-up VMs after a successful run.
+	PruneAfterRun bool `yaml:"prune_after_run"`
+	// S3 configures s3:// backup targets.
+	S3 S3Config `yaml:"s3"`
+	// Swift configures swift:// backup targets.
+	Swift SwiftConfig `yaml:"swift"`
+	// Compression is the codec for volume images: none (default), gzip, or zstd.
+	Compression string `yaml:"compression"`
+	// CompressionLevel is the codec level (gzip 1-9, zstd 1-22); 0 = codec default.
+	CompressionLevel int `yaml:"compression_level"`
+	// CompressionWorkers is the number of compression goroutines per image; 0 = GOMAXPROCS.
+	CompressionWorkers int `yaml:"compression_workers"`
+	// Dedup stores volume images as content-defined chunks in a shared chunk store, with a
+	// per-backup chunk index, so unchanged data is stored once.
+	Dedup bool `yaml:"dedup"`
+	// DedupAvgChunkKB is the average chunk size (min = avg/4, max = avg×4); 0 = 1024.
+	DedupAvgChunkKB int `yaml:"dedup_avg_chunk_kb"`
+	// ChunkStore is the chunk store location (path or target URL); empty = <backup target>/_chunks.
+	ChunkStore string `yaml:"chunk_store"`
+	// Encryption enables client-side encryption of everything written to the backup target.
+	Encryption EncryptionConfig `yaml:"encryption"`
+	// Targets backs up several clouds or regions in one invocation, each under <target>/<name>;
+	// each entry overrides top-level keys (credentials, region, filters, ...) for its cloud.
+	Targets []TargetConfig `yaml:"targets"`
+
+	// targetName is the name of the target this config was built for (TargetConfigs).
+	targetName string
 }
 
 // VMPair holds a VM name and its OpenStack server ID.
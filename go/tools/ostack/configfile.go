@@ -10,17 +10,75 @@ import (
 
 // defaultConfigYAML is written when cfg/config.yaml does not exist.
 const defaultConfigYAML = `# protect-ostack default config (edit as needed)
-# Required at runtime or via CLI: keystone_url, project, user, password
+# Required at runtime or via CLI: keystone_url, project, user, password (or password_file, password_env, password_command)
+# A file holding secrets must not be readable by other users (chmod 600)
+# (auth_type: application_credential needs application_credential_id and _secret instead)
+# clouds.yaml (--os-cloud / OS_CLOUD) and OS_* environment variables override this file; CLI flags override both
 
 keystone_url: ""
+auth_type: "password"   # password, application_credential, or token
 project: ""
 user: ""
 password: ""
+# Instead of password (keeps it out of this file): a file holding it, an environment variable,
+# or a command printing it (sh -c, e.g. "pass show openstack/backup")
+password_file: ""
+password_env: ""
+password_command: ""
 
 domain: "Default"
+# Separate user and project domains (name or ID); empty = domain
+user_domain: ""
+user_domain_id: ""
+project_domain: ""
+project_domain_id: ""
+project_id: ""          # instead of project + project domain
+user_id: ""             # instead of user + user domain
+# auth_type: application_credential (the credential's project is used; project is ignored)
+application_credential_id: ""
+application_credential_name: ""   # with user or user_id, instead of the ID
+application_credential_secret: ""
+# auth_type: token (an existing Keystone token, e.g. from "openstack token issue"; not renewed)
+token: ""
 region: "RegionOne"
+# Catalog endpoint interface: public (default), internal, or admin
+interface: ""
+# TLS for Keystone, the OpenStack endpoints, and S3
+tls:
+  ca_file: ""           # PEM CA bundle trusted in addition to the system roots (e.g. an internal CA)
+  cert_file: ""         # PEM client certificate and key, if the endpoints require one
+  key_file: ""
+  insecure_skip_verify: false   # lab clouds only
 backup_dir: "/backup/openstack"
+# Where artifacts are stored; empty = backup_dir. e.g. file:///backup/openstack, s3://bucket/prefix, swift://container/prefix
+backup_target: ""
 disk_format: "qcow2"
+# How volumes are backed up: glance-export (snapshot -> temp volume -> Glance image -> download)
+# or cinder-backup (the Cinder backup service; the data stays in the cloud's backup store)
+backup_method: "glance-export"
+cinder_backup:
+  incremental: false    # incremental against the volume's previous backup (the first one is full)
+  full_every: 0         # full backup after N incremental ones, so prune can free old chains; 0 = never
+  container: ""         # backup driver container/pool; empty = driver default
+# Snapshot all volumes of a VM at the same point in time with a Cinder group snapshot
+# (needs block storage API 3.14 and a group type; use one with consistent_group_snapshot_enabled)
+group_snapshots: false
+group_type: ""
+# Filesystem-consistent snapshots: freeze the guest while its volumes are snapshotted.
+# Per VM, the server metadata protect-ostack:quiesce=true|false overrides quiesce.
+# Image-booted root disks are quiesced by Nova (image property hw_qemu_guest_agent=yes).
+quiesce: false
+freeze_command: ""      # e.g. ssh root@$PROTECT_OSTACK_VM_NAME fsfreeze -f /data
+thaw_command: ""        # e.g. ssh root@$PROTECT_OSTACK_VM_NAME fsfreeze -u /data
+quiesce_timeout_sec: 60
+# Image-booted servers: their ephemeral root disk is snapshotted with Nova createImage and
+# downloaded as root-disk.<format>; true = back up only their volumes and config
+skip_ephemeral_root: false
+# Back up several projects, each with its own project-scoped token, into backup_dir/<project>/<vm>/...
+# Names or IDs, or ["*"] for every project the user can access; empty = the project above.
+# The max_parallel_* limits are shared by all projects.
+projects: []
+project_role: ""        # skip projects where the user lacks this role (e.g. backup)
 discover_all: true
 max_parallel_snap_shots: 0
 max_parallel_volumes: 0
@@ -29,6 +87,90 @@ status_interval_sec: 5
 vm_filter: ""
 vm_tags: ""
 vm_list: []
+# Volumes to back up: attached (the selected VMs' volumes), all (also unattached volumes),
+# or unattached (only unattached volumes, no VMs). Unattached volumes go to
+# <backup_dir>/_volumes/<volume name>-<id[:8]>/YYYY-MM-DD_HH-MM/ and are selected by:
+discover_volumes: "attached"
+volume_filter: ""       # name pattern, e.g. data-*
+volume_metadata: ""     # key:value,... (a key alone must be present)
+volume_types: []        # e.g. [ssd, hdd]
+
+# Retention (grandfather-father-son); all 0 keeps every backup.
+keep_last: 0
+keep_daily: 0
+keep_weekly: 0
+keep_monthly: 0
+prune_after_run: false
+# Keep each volume's snapshot in the cloud for fast restores (restore --from-snapshot):
+# the newest N per volume are kept, older ones deleted; 0 = delete after each backup
+snapshot_retention: 0
+# Per-VM policies replace the global keys, e.g.:
+# retention_overrides:
+#   db-1: {keep_daily: 14, keep_weekly: 8, keep_monthly: 12}
+retention_overrides: {}
+
+# Commands run (sh -c) before/after the whole run and each VM backup, e.g. to flush a database or
+# notify a channel. They get PROTECT_OSTACK_HOOK, PROTECT_OSTACK_BACKUP_DIR, PROTECT_OSTACK_VM_NAME,
+# PROTECT_OSTACK_VM_ID, and for post hooks PROTECT_OSTACK_RESULT (success, failure, skipped) and PROTECT_OSTACK_ERROR.
+hooks:
+  pre_run: ""
+  post_run: ""
+  pre_vm: ""
+  post_vm: ""
+  timeout_sec: 300
+  on_pre_failure: "skip" # skip: a failed pre_vm skips the VM, a failed pre_run the run; continue: back up anyway
+
+# S3 / S3-compatible (MinIO, Ceph RGW) target: backup_target: "s3://BUCKET/PREFIX"
+s3:
+  endpoint: ""          # e.g. https://minio.example.com:9000; empty = AWS S3
+  region: ""
+  access_key: ""        # empty = AWS_*/MINIO_* env vars or ~/.aws/credentials
+  secret_key: ""
+  part_size_mb: 64      # initial multipart part size (min 5), doubled every 1000 parts
+  part_retries: 3
+  sse: ""               # "", AES256, or aws:kms
+  sse_kms_key_id: ""
+  resume: false         # continue incomplete multipart uploads instead of restarting
+
+# OpenStack Swift target: backup_target: "swift://CONTAINER/PREFIX"
+swift:
+  region: ""            # empty = region; set for off-site copies in another region
+  segment_size_mb: 1024 # Static Large Object segment size (objects > 8 MB are segmented)
+  segment_container: "" # empty = <container>_segments
+  # Another cloud for off-site copies; empty keystone_url = the credentials above
+  keystone_url: ""
+  project: ""
+  user: ""
+  password: ""
+  domain: ""
+
+# Streaming compression of volume images: none, gzip, or zstd (adds .gz / .zst to the file name)
+compression: "none"
+compression_level: 0    # 0 = codec default; gzip 1-9, zstd 1-22
+compression_workers: 0  # goroutines per image; 0 = number of CPUs
+
+# Deduplicated repository: store volume images as content-defined chunks shared across runs
+# (only changed data is stored again). Run "protect-ostack gc" after prune to free chunks.
+dedup: false
+dedup_avg_chunk_kb: 1024  # average chunk size; min = avg/4, max = avg*4
+chunk_store: ""           # path or target URL; empty = <backup target>/_chunks
+
+# Client-side encryption (AES-256-GCM) of every object written to the backup target.
+# Key: 32 bytes raw, 64 hex characters, or base64 (e.g. openssl rand -hex 32).
+encryption:
+  key_file: ""          # e.g. /etc/protect-ostack/backup.key
+  key_env: ""           # or the name of an environment variable holding the key
+
+# Back up several clouds or regions in one run, one after the other, each into
+# <backup target>/<name>/... Each target starts from the settings above, then applies its
+# clouds.yaml cloud (if any), then its own keys (any key above, e.g. region or vm_filter).
+targets: []
+#  - name: east
+#    cloud: prod-east
+#  - name: west
+#    cloud: prod-east
+#    region: RegionWest
+#    vm_filter: "prod-*"
 `
 
 // LoadConfig reads config from path (YAML). If the file does not exist,
@@ -52,6 +194,9 @@ func LoadConfig(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
+	if err := checkConfigPermissions(path, cfg); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
@@ -60,5 +205,6 @@ func ensureDefaultConfig(path string) error {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
-	return os.WriteFile(path, []byte(defaultConfigYAML), 0644)
+	// 0600: the file is meant to be edited and may end up holding the password.
+	return os.WriteFile(path, []byte(defaultConfigYAML), 0600)
 }
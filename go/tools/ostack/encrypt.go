@@ -0,0 +1,313 @@
+package ostack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// EncryptionConfig enables client-side encryption of every object written to the backup target.
+// The key is 32 bytes (AES-256), given raw, hex, or base64.
+type EncryptionConfig struct {
+	// KeyFile is a file holding the key.
+	KeyFile string `yaml:"key_file"`
+	// KeyEnv names an environment variable holding the key (hex or base64).
+	KeyEnv string `yaml:"key_env"`
+}
+
+// Enabled reports whether a key source is configured.
+func (c EncryptionConfig) Enabled() bool {
+	return c.KeyFile != "" || c.KeyEnv != ""
+}
+
+// EncryptionCipher is recorded in manifests of encrypted runs.
+const EncryptionCipher = "aes-256-gcm-chunked"
+
+// Encrypted objects are a header followed by AES-256-GCM chunks:
+//
+//	magic (8) | chunk size uint32 (4) | key ID (8) | salt (32)
+//	chunk: ciphertext of up to chunk size bytes | GCM tag (16)
+//
+// Each object is sealed with its own key, HKDF-SHA256(master key, salt). Chunk i uses the nonce
+// 0^7 | i (uint32) | final flag, so reordered, dropped, or truncated chunks fail authentication.
+// The key ID (first 8 bytes of SHA-256 of the master key) only makes wrong-key errors readable.
+const (
+	encMagic     = "POENC\x00\x00\x01"
+	encChunkSize = 64 << 10
+	encSaltSize  = 32
+	encHeaderLen = len(encMagic) + 4 + 8 + encSaltSize
+	encTagSize   = 16
+	encHKDFInfo  = "protect-ostack object key v1"
+)
+
+// LoadEncryptionKey reads the 32-byte master key from c.KeyFile or c.KeyEnv.
+func LoadEncryptionKey(c EncryptionConfig) ([]byte, error) {
+	var raw []byte
+	switch {
+	case c.KeyFile != "":
+		data, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read encryption key: %w", err)
+		}
+		if len(data) == 32 {
+			return data, nil
+		}
+		raw = data
+	case c.KeyEnv != "":
+		v, ok := os.LookupEnv(c.KeyEnv)
+		if !ok || v == "" {
+			return nil, fmt.Errorf("encryption key: environment variable %s is not set", c.KeyEnv)
+		}
+		raw = []byte(v)
+	default:
+		return nil, errors.New("encryption key: set key_file or key_env")
+	}
+	s := strings.TrimSpace(string(raw))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("encryption key must be 32 bytes (raw, 64 hex characters, or base64)")
+}
+
+// EncryptSink encrypts objects written to base and decrypts objects read from it.
+// Keys, and so the VM/TIMESTAMP layout, are not encrypted.
+type EncryptSink struct {
+	base  Sink
+	key   []byte
+	keyID []byte
+}
+
+// NewEncryptSink wraps base with encryption under the 32-byte master key.
+func NewEncryptSink(base Sink, key []byte) *EncryptSink {
+	id := sha256.Sum256(key)
+	return &EncryptSink{base: base, key: key, keyID: id[:8]}
+}
+
+func (s *EncryptSink) aead(salt []byte) (cipher.AEAD, error) {
+	objKey, err := hkdf.Key(sha256.New, s.key, salt, encHKDFInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(objKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *EncryptSink) Create(ctx context.Context, key string) (SinkWriter, error) {
+	header := make([]byte, encHeaderLen)
+	copy(header, encMagic)
+	binary.BigEndian.PutUint32(header[len(encMagic):], encChunkSize)
+	copy(header[len(encMagic)+4:], s.keyID)
+	salt := header[len(encMagic)+12:]
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := s.aead(salt)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.base.Create(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, encChunkSize)}, nil
+}
+
+func (s *EncryptSink) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := s.base.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(rc, encChunkSize+encTagSize+1)
+	header := make([]byte, encHeaderLen)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(encMagic)]) != encMagic {
+		rc.Close()
+		return nil, fmt.Errorf("%s: not an encrypted object", key)
+	}
+	if !bytes.Equal(header[len(encMagic)+4:len(encMagic)+12], s.keyID) {
+		rc.Close()
+		return nil, fmt.Errorf("%s: encrypted with a different key (key ID %x, have %x)", key, header[len(encMagic)+4:len(encMagic)+12], s.keyID)
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(encMagic):])
+	if chunkSize == 0 || chunkSize > 16<<20 {
+		rc.Close()
+		return nil, fmt.Errorf("%s: invalid chunk size %d", key, chunkSize)
+	}
+	aead, err := s.aead(header[len(encMagic)+12:])
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &decryptReader{rc: rc, br: br, aead: aead, key: key, chunk: make([]byte, int(chunkSize)+encTagSize)}, nil
+}
+
+// List reports plaintext sizes, derived from the ciphertext size.
+func (s *EncryptSink) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objs, err := s.base.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range objs {
+		objs[i].Size = encPlaintextSize(objs[i].Size)
+	}
+	return objs, nil
+}
+
+func (s *EncryptSink) Delete(ctx context.Context, key string) error {
+	return s.base.Delete(ctx, key)
+}
+
+func (s *EncryptSink) String() string {
+	return s.base.String()
+}
+
+// encPlaintextSize returns the plaintext size of an encrypted object of n bytes.
+// Every chunk but the last is full, and there is always a last chunk.
+func encPlaintextSize(n int64) int64 {
+	n -= int64(encHeaderLen)
+	if n < encTagSize {
+		return 0
+	}
+	chunks := (n + encChunkSize + encTagSize - 1) / (encChunkSize + encTagSize)
+	return n - chunks*encTagSize
+}
+
+func encNonce(counter uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	w       SinkWriter
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint32
+	out     []byte
+	done    bool
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// A full buffer is only sealed once more data arrives, so the final chunk is never
+		// followed by an empty one and its size is always known on Close.
+		if len(w.buf) == cap(w.buf) {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *encryptWriter) seal(final bool) error {
+	if w.counter == ^uint32(0) {
+		return errors.New("encrypted object too large")
+	}
+	w.out = w.aead.Seal(w.out[:0], encNonce(w.counter, final), w.buf, nil)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(w.out)
+	return err
+}
+
+func (w *encryptWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if err := w.seal(true); err != nil {
+		w.w.Abort()
+		return err
+	}
+	return w.w.Close()
+}
+
+func (w *encryptWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	return w.w.Abort()
+}
+
+type decryptReader struct {
+	rc      io.ReadCloser
+	br      *bufio.Reader
+	aead    cipher.AEAD
+	key     string
+	chunk   []byte
+	plain   []byte
+	counter uint32
+	final   bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.final {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk. A short chunk, or a full one at end of stream, is the final one.
+func (r *decryptReader) next() error {
+	n, err := io.ReadFull(r.br, r.chunk)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		r.final = true
+	case err != nil:
+		return err
+	default:
+		if _, err := r.br.Peek(1); err == io.EOF {
+			r.final = true
+		}
+	}
+	plain, err := r.aead.Open(r.chunk[:0], encNonce(r.counter, r.final), r.chunk[:n], nil)
+	if err != nil {
+		return fmt.Errorf("%s: decrypt chunk %d: authentication failed (corrupt, truncated, or tampered)", r.key, r.counter)
+	}
+	r.counter++
+	r.plain = plain
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.rc.Close()
+}
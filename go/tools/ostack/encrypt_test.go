@@ -0,0 +1,181 @@
+package ostack
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func readAll(t *testing.T, s Sink, key string) ([]byte, error) {
+	t.Helper()
+	rc, err := s.Open(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func TestEncryptSinkRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"below chunk", encChunkSize - 1},
+		{"one chunk", encChunkSize},
+		{"above chunk", encChunkSize + 1},
+		{"three chunks", 3 * encChunkSize},
+		{"uneven", 2*encChunkSize + 12345},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := NewFileSink(t.TempDir())
+			s := NewEncryptSink(base, testKey(1))
+			data := make([]byte, tt.size)
+			rand.New(rand.NewSource(int64(tt.size))).Read(data)
+			if err := writeObject(ctx, s, "vm1/obj", data); err != nil {
+				t.Fatal(err)
+			}
+
+			raw, err := readAll(t, base, "vm1/obj")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.size >= 16 && bytes.Contains(raw, data) {
+				t.Error("ciphertext contains the plaintext")
+			}
+			got, err := readAll(t, s, "vm1/obj")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("round trip: got %d bytes, want %d", len(got), len(data))
+			}
+			objs, err := s.List(ctx, "vm1/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(objs) != 1 || objs[0].Size != int64(tt.size) {
+				t.Errorf("List = %+v, want size %d", objs, tt.size)
+			}
+		})
+	}
+}
+
+func TestEncryptSinkTamper(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 2*encChunkSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	full := encChunkSize + encTagSize
+	tests := []struct {
+		name   string
+		modify func([]byte) []byte
+	}{
+		{"flipped first chunk byte", func(b []byte) []byte { b[encHeaderLen+10] ^= 1; return b }},
+		{"flipped last chunk byte", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }},
+		{"flipped salt", func(b []byte) []byte { b[encHeaderLen-1] ^= 1; return b }},
+		{"truncated to whole chunks", func(b []byte) []byte { return b[:encHeaderLen+2*full] }},
+		{"truncated mid chunk", func(b []byte) []byte { return b[:encHeaderLen+full+100] }},
+		{"chunks swapped", func(b []byte) []byte {
+			c := append([]byte(nil), b...)
+			copy(c[encHeaderLen:], b[encHeaderLen+full:encHeaderLen+2*full])
+			copy(c[encHeaderLen+full:], b[encHeaderLen:encHeaderLen+full])
+			return c
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := NewEncryptSink(NewFileSink(dir), testKey(1))
+			if err := writeObject(ctx, s, "obj", data); err != nil {
+				t.Fatal(err)
+			}
+			p := filepath.Join(dir, "obj")
+			raw, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, tt.modify(raw), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readAll(t, s, "obj"); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+				t.Errorf("read tampered object: err = %v, want authentication failure", err)
+			}
+		})
+	}
+}
+
+func TestEncryptSinkWrongKey(t *testing.T) {
+	ctx := context.Background()
+	base := NewFileSink(t.TempDir())
+	if err := writeObject(ctx, NewEncryptSink(base, testKey(1)), "obj", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAll(t, NewEncryptSink(base, testKey(2)), "obj"); err == nil || !strings.Contains(err.Error(), "different key") {
+		t.Errorf("err = %v, want different key error", err)
+	}
+	if err := writeObject(ctx, base, "plain", []byte("not encrypted")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAll(t, NewEncryptSink(base, testKey(1)), "plain"); err == nil || !strings.Contains(err.Error(), "not an encrypted object") {
+		t.Errorf("err = %v, want not encrypted error", err)
+	}
+}
+
+func TestLoadEncryptionKey(t *testing.T) {
+	key := testKey(7)
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	t.Setenv("TEST_OSTACK_KEY", hex.EncodeToString(key))
+	tests := []struct {
+		name    string
+		cfg     EncryptionConfig
+		wantErr bool
+	}{
+		{"raw file", EncryptionConfig{KeyFile: write("raw", key)}, false},
+		{"hex file", EncryptionConfig{KeyFile: write("hex", []byte(hex.EncodeToString(key)+"\n"))}, false},
+		{"base64 file", EncryptionConfig{KeyFile: write("b64", []byte(base64.StdEncoding.EncodeToString(key)))}, false},
+		{"hex env", EncryptionConfig{KeyEnv: "TEST_OSTACK_KEY"}, false},
+		{"short key", EncryptionConfig{KeyFile: write("short", []byte("abcd"))}, true},
+		{"unset env", EncryptionConfig{KeyEnv: "TEST_OSTACK_KEY_UNSET"}, true},
+		{"missing file", EncryptionConfig{KeyFile: filepath.Join(dir, "missing")}, true},
+		{"no source", EncryptionConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadEncryptionKey(tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got key %x, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, key) {
+				t.Errorf("got %x, want %x", got, key)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package ostack
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/flavors"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+)
+
+// RootDiskID stands in for the volume ID of an image-booted server's ephemeral root disk:
+// it is backed up as root-disk.<format> and recorded with this volume ID.
+const RootDiskID = "root-disk"
+
+// bootImageID returns the Glance image an image-booted server runs from, or "" for a
+// volume-booted server (whose root disk is a Cinder volume).
+func bootImageID(srv *servers.Server) string {
+	id, _ := srv.Image["id"].(string)
+	return id
+}
+
+// flavorDiskGB returns the root disk size of the server's flavor, or 0 if unknown.
+// The flavor is embedded in the server from compute microversion 2.47; older ones only give its ID.
+func flavorDiskGB(ctx context.Context, computeClient *gophercloud.ServiceClient, srv *servers.Server) int {
+	if disk, ok := srv.Flavor["disk"].(float64); ok {
+		return int(disk)
+	}
+	id, _ := srv.Flavor["id"].(string)
+	if id == "" {
+		return 0
+	}
+	f, err := flavors.Get(ctx, computeClient, id).Extract()
+	if err != nil {
+		log.Printf("Warning: Failed to get flavor %s: %v", id, err)
+		return 0
+	}
+	return f.Disk
+}
+
+// BackupRootDisk snapshots the ephemeral root disk of an image-booted server with Nova's createImage,
+// waits for the image, downloads it into dest as root-disk.<format> (through a chunk store, if set),
+// and deletes the image. Returns the manifest entry for the downloaded file.
+func BackupRootDisk(ctx context.Context, computeClient, imageClient *gophercloud.ServiceClient, cfg *Config, srv *servers.Server, dest Sink, chunks *ChunkStore) (*Artifact, error) {
+	prov := &VolumeProvenance{
+		VolumeID:  RootDiskID,
+		SizeGB:    flavorDiskGB(ctx, computeClient, srv),
+		StartedAt: time.Now().UTC(),
+	}
+	timestamp := time.Now().Format("2006-01-02_1504")
+	log.Printf("Backing up ephemeral root disk of %s (image %s)", srv.Name, bootImageID(srv))
+
+	imgID, err := servers.CreateImage(ctx, computeClient, srv.ID, servers.CreateImageOpts{
+		Name: "protect-ostack-root-" + srv.ID + "-" + timestamp,
+	}).ExtractImageID()
+	if err != nil {
+		return nil, fmt.Errorf("create image: %w", err)
+	}
+	prov.ImageID = imgID
+	defer func() {
+		if err := images.Delete(ctx, imageClient, imgID).ExtractErr(); err != nil {
+			log.Printf("Warning: Failed to delete image %s: %v", imgID, err)
+		} else {
+			log.Printf("Cleaned up image: %s", imgID)
+		}
+	}()
+
+	if err := waitImageActive(ctx, imageClient, cfg, imgID); err != nil {
+		return nil, err
+	}
+	img, err := images.Get(ctx, imageClient, imgID).Extract()
+	if err != nil {
+		return nil, err
+	}
+	// Nova snapshots in the hypervisor's native format (qcow2 for local disks, raw for Ceph).
+	if !SupportedDiskFormats[img.DiskFormat] {
+		return nil, fmt.Errorf("image %s has unsupported disk format %q", imgID, img.DiskFormat)
+	}
+	prov.DiskFormat = img.DiskFormat
+
+	art, err := downloadImage(ctx, imageClient, cfg, imgID, dest, chunks, RootDiskID+"."+img.DiskFormat)
+	if err != nil {
+		return nil, err
+	}
+	art.Kind = ArtifactRootDisk
+	art.Volume = prov
+	prov.FinishedAt = time.Now().UTC()
+	log.Printf("Root disk of %s backed up", srv.Name)
+	return art, nil
+}
@@ -0,0 +1,131 @@
+package ostack
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FileSink stores artifacts as files under a local directory (the default backup target).
+type FileSink struct {
+	Root string
+}
+
+// NewFileSink returns a sink rooted at dir.
+func NewFileSink(dir string) *FileSink {
+	return &FileSink{Root: dir}
+}
+
+func (s *FileSink) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(key))
+}
+
+// Create writes to a temporary file next to key and renames it into place on Close.
+func (s *FileSink) Create(ctx context.Context, key string) (SinkWriter, error) {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(p + ".partial")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{f: f, path: p}, nil
+}
+
+func (s *FileSink) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return f, err
+}
+
+// List walks only the directory part of prefix (e.g. Root/vm1 for "vm1/2026"), so listing one VM
+// does not read the rest of the repository.
+func (s *FileSink) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objs []ObjectInfo
+	start := s.path(prefix[:strings.LastIndex(prefix, "/")+1])
+	err := filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == start {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(p, ".partial") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objs = append(objs, ObjectInfo{Key: key, Size: info.Size()})
+		return nil
+	})
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key < objs[j].Key })
+	return objs, err
+}
+
+// Delete removes key and any parent directories it leaves empty (up to Root).
+func (s *FileSink) Delete(ctx context.Context, key string) error {
+	p := s.path(key)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	root := filepath.Clean(s.Root)
+	for dir := filepath.Dir(p); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *FileSink) String() string {
+	return s.Root
+}
+
+type fileWriter struct {
+	f    *os.File
+	path string
+	done bool
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *fileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return os.Rename(w.f.Name(), w.path)
+}
+
+func (w *fileWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
@@ -0,0 +1,209 @@
+package ostack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/v2/pagination"
+)
+
+// Generic volume groups and group snapshots need block storage microversion 3.14.
+// Gophercloud has no client for them, so the requests are made directly.
+const groupMicroversion = "3.14"
+
+// groupSnapshot is a Cinder group snapshot of a VM's volumes, taken through a temporary volume group.
+type groupSnapshot struct {
+	client  *gophercloud.ServiceClient
+	cfg     *Config
+	groupID string
+	// ID is the group snapshot ID; empty if it was never created.
+	ID string
+	// Members maps each volume ID to its snapshot in the group snapshot.
+	Members map[string]string
+}
+
+type cinderGroup struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+// createGroupSnapshot puts volIDs into a temporary volume group of the configured group type and takes
+// one group snapshot of them, so all volumes are captured at the same point in time. The guest is
+// frozen with f (if not nil) only while the group snapshot is taken.
+// Call Delete when the member snapshots are no longer needed, also after an error.
+func createGroupSnapshot(ctx context.Context, blockClient *gophercloud.ServiceClient, cfg *Config, f *guestFreezer, vmName string, volIDs []string) (*groupSnapshot, error) {
+	if cfg.GroupType == "" {
+		return nil, errors.New("group_snapshots needs group_type")
+	}
+	client := *blockClient
+	client.Microversion = groupMicroversion
+	gs := &groupSnapshot{client: &client, cfg: cfg}
+	timestamp := time.Now().Format("2006-01-02_1504")
+
+	var volTypes []string
+	seen := map[string]bool{}
+	for _, id := range volIDs {
+		vol, err := volumes.Get(ctx, blockClient, id).Extract()
+		if err != nil {
+			return gs, err
+		}
+		if vol.VolumeType != "" && !seen[vol.VolumeType] {
+			seen[vol.VolumeType] = true
+			volTypes = append(volTypes, vol.VolumeType)
+		}
+	}
+
+	var created struct {
+		Group cinderGroup `json:"group"`
+	}
+	_, err := gs.client.Post(ctx, gs.client.ServiceURL("groups"), map[string]any{"group": map[string]any{
+		"name":         "protect-ostack-" + vmName + "-" + timestamp,
+		"group_type":   cfg.GroupType,
+		"volume_types": volTypes,
+	}}, &created, &gophercloud.RequestOpts{OkCodes: []int{202}})
+	if err != nil {
+		return gs, fmt.Errorf("create group: %w", err)
+	}
+	gs.groupID = created.Group.ID
+	log.Printf("Created volume group %s for %s", gs.groupID, vmName)
+	if err := gs.waitGroup(ctx, "available"); err != nil {
+		return gs, err
+	}
+
+	_, err = gs.client.Put(ctx, gs.client.ServiceURL("groups", gs.groupID), map[string]any{"group": map[string]any{
+		"add_volumes": strings.Join(volIDs, ","),
+	}}, nil, &gophercloud.RequestOpts{OkCodes: []int{202}})
+	if err != nil {
+		return gs, fmt.Errorf("add volumes to group %s: %w", gs.groupID, err)
+	}
+	if err := gs.waitGroup(ctx, "available"); err != nil {
+		return gs, err
+	}
+
+	var snap struct {
+		GroupSnapshot cinderGroup `json:"group_snapshot"`
+	}
+	f.Freeze(ctx)
+	_, err = gs.client.Post(ctx, gs.client.ServiceURL("group_snapshots"), map[string]any{"group_snapshot": map[string]any{
+		"group_id": gs.groupID,
+		"name":     "protect-ostack-" + vmName + "-" + timestamp,
+	}}, &snap, &gophercloud.RequestOpts{OkCodes: []int{202}})
+	if err != nil {
+		f.Thaw(ctx)
+		return gs, fmt.Errorf("create group snapshot: %w", err)
+	}
+	gs.ID = snap.GroupSnapshot.ID
+	log.Printf("Created group snapshot %s of %d volume(s)", gs.ID, len(volIDs))
+	err = gs.wait(ctx, "group_snapshots", gs.ID, "group_snapshot", "available")
+	f.Thaw(ctx)
+	if err != nil {
+		return gs, err
+	}
+
+	gs.Members = map[string]string{}
+	for _, id := range volIDs {
+		err := snapshots.ListDetail(gs.client, snapshots.ListOpts{VolumeID: id}).EachPage(ctx,
+			func(_ context.Context, page pagination.Page) (bool, error) {
+				list, err := snapshots.ExtractSnapshots(page)
+				if err != nil {
+					return false, err
+				}
+				for _, s := range list {
+					if s.GroupSnapshotID == gs.ID {
+						gs.Members[id] = s.ID
+						return false, nil
+					}
+				}
+				return true, nil
+			})
+		if err != nil {
+			return gs, fmt.Errorf("list snapshots of volume %s: %w", id, err)
+		}
+		if gs.Members[id] == "" {
+			return gs, fmt.Errorf("group snapshot %s has no snapshot of volume %s", gs.ID, id)
+		}
+	}
+	return gs, nil
+}
+
+func (gs *groupSnapshot) waitGroup(ctx context.Context, want string) error {
+	return gs.wait(ctx, "groups", gs.groupID, "group", want)
+}
+
+// wait polls GET /<path>/<id> until the resource under key reaches status want, using the
+// status timeout/interval from config.
+func (gs *groupSnapshot) wait(ctx context.Context, path, id, key, want string) error {
+	timeout := time.Duration(gs.cfg.StatusTimeoutSec) * time.Second
+	interval := time.Duration(gs.cfg.StatusIntervalSec) * time.Second
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		ensureToken(ctx, gs.client)
+		var body map[string]cinderGroup
+		if _, err := gs.client.Get(ctx, gs.client.ServiceURL(path, id), &body, nil); err != nil {
+			return err
+		}
+		switch status := body[key].Status; status {
+		case want:
+			return nil
+		case "error", "error_deleting":
+			return fmt.Errorf("%s %s entered %s state", key, id, status)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+	return fmt.Errorf("timeout waiting for %s %s", key, id)
+}
+
+// Delete removes the group snapshot (and with it the member snapshots), takes the volumes out of
+// the temporary group, and deletes the group. The volumes themselves are not touched.
+// Failures are logged.
+func (gs *groupSnapshot) Delete(ctx context.Context, volIDs []string) {
+	if gs.ID != "" {
+		if _, err := gs.client.Delete(ctx, gs.client.ServiceURL("group_snapshots", gs.ID), &gophercloud.RequestOpts{OkCodes: []int{202}}); err != nil {
+			log.Printf("Warning: Failed to delete group snapshot %s: %v", gs.ID, err)
+		} else {
+			log.Printf("Cleaned up group snapshot: %s", gs.ID)
+		}
+	}
+	if gs.groupID == "" {
+		return
+	}
+	// A group with volumes can only be deleted together with them, so empty it first. Volumes cannot
+	// leave the group while it still has a snapshot.
+	deadline := time.Now().Add(time.Duration(gs.cfg.StatusTimeoutSec) * time.Second)
+	for {
+		_, err := gs.client.Put(ctx, gs.client.ServiceURL("groups", gs.groupID), map[string]any{"group": map[string]any{
+			"remove_volumes": strings.Join(volIDs, ","),
+		}}, nil, &gophercloud.RequestOpts{OkCodes: []int{202}})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) || !gophercloud.ResponseCodeIs(err, 400) {
+			log.Printf("Warning: Failed to remove volumes from group %s: %v", gs.groupID, err)
+			return
+		}
+		time.Sleep(time.Duration(gs.cfg.StatusIntervalSec) * time.Second)
+	}
+	if err := gs.waitGroup(ctx, "available"); err != nil {
+		log.Printf("Warning: Failed to delete group %s: %v", gs.groupID, err)
+		return
+	}
+	_, err := gs.client.Post(ctx, gs.client.ServiceURL("groups", gs.groupID, "action"), map[string]any{
+		"delete": map[string]any{"delete-volumes": false},
+	}, nil, &gophercloud.RequestOpts{OkCodes: []int{202}})
+	if err != nil {
+		log.Printf("Warning: Failed to delete group %s: %v", gs.groupID, err)
+		return
+	}
+	log.Printf("Cleaned up volume group: %s", gs.groupID)
+}
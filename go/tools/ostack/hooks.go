@@ -0,0 +1,144 @@
+package ostack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Hook failure policies (hooks.on_pre_failure).
+const (
+	// HookFailureSkip skips the VM when pre_vm fails, and the whole run when pre_run fails.
+	HookFailureSkip = "skip"
+	// HookFailureContinue logs the failure and backs up anyway.
+	HookFailureContinue = "continue"
+)
+
+// Hook results passed to post hooks in PROTECT_OSTACK_RESULT.
+const (
+	HookResultSuccess = "success"
+	HookResultFailure = "failure"
+	HookResultSkipped = "skipped"
+)
+
+// defaultHookTimeout bounds each hook when hooks.timeout_sec is 0.
+const defaultHookTimeout = 5 * time.Minute
+
+// HooksConfig holds commands run around the backup run and around each VM. Commands are run with
+// sh -c and get the run in PROTECT_OSTACK_* environment variables; empty = no hook.
+type HooksConfig struct {
+	PreRun  string `yaml:"pre_run"`
+	PostRun string `yaml:"post_run"`
+	PreVM   string `yaml:"pre_vm"`
+	PostVM  string `yaml:"post_vm"`
+	// TimeoutSec bounds each hook; 0 = 300.
+	TimeoutSec int `yaml:"timeout_sec"`
+	// OnPreFailure is skip (default) or continue.
+	OnPreFailure string `yaml:"on_pre_failure"`
+}
+
+// ValidateHooks checks hooks.on_pre_failure in cfg.
+func ValidateHooks(cfg *Config) error {
+	switch cfg.Hooks.OnPreFailure {
+	case "", HookFailureSkip, HookFailureContinue:
+		return nil
+	}
+	return fmt.Errorf("unsupported hooks.on_pre_failure %q (supported: %s, %s)", cfg.Hooks.OnPreFailure, HookFailureSkip, HookFailureContinue)
+}
+
+// skipOnPreFailure reports whether a failed pre hook skips the VM (or run).
+func (h HooksConfig) skipOnPreFailure() bool {
+	return h.OnPreFailure != HookFailureContinue
+}
+
+// hookEnv holds the PROTECT_OSTACK_* variables of one hook invocation.
+type hookEnv struct {
+	vm        *VMPair
+	backupDir string
+	// project is set for the VMs of a multi-project run.
+	project string
+	// target is set from cfg for the runs of targets.
+	target string
+	// result and err are passed to post hooks.
+	result string
+	err    error
+}
+
+func (e hookEnv) environ(hook string) []string {
+	env := []string{
+		"PROTECT_OSTACK_HOOK=" + hook,
+		"PROTECT_OSTACK_BACKUP_DIR=" + e.backupDir,
+	}
+	if e.vm != nil {
+		env = append(env, "PROTECT_OSTACK_VM_NAME="+e.vm.Name, "PROTECT_OSTACK_VM_ID="+e.vm.ID)
+	}
+	if e.project != "" {
+		env = append(env, "PROTECT_OSTACK_PROJECT="+e.project)
+	}
+	if e.target != "" {
+		env = append(env, "PROTECT_OSTACK_TARGET="+e.target)
+	}
+	if e.result != "" {
+		env = append(env, "PROTECT_OSTACK_RESULT="+e.result)
+	}
+	if e.err != nil {
+		env = append(env, "PROTECT_OSTACK_ERROR="+e.err.Error())
+	}
+	return env
+}
+
+// runHook runs the hook named hook (pre_run, pre_vm, ...) if command is set, logging its output.
+// Post hooks run even if ctx is canceled.
+func runHook(ctx context.Context, cfg *Config, hook, command string, env hookEnv) error {
+	if command == "" {
+		return nil
+	}
+	if strings.HasPrefix(hook, "post_") {
+		ctx = context.WithoutCancel(ctx)
+	}
+	timeout := defaultHookTimeout
+	if cfg.Hooks.TimeoutSec > 0 {
+		timeout = time.Duration(cfg.Hooks.TimeoutSec) * time.Second
+	}
+	env.target = cfg.targetName
+	label := hook
+	if env.vm != nil {
+		label += " " + env.vm.Name
+		log.Printf("Running %s hook for %s", hook, env.vm.Name)
+	} else {
+		log.Printf("Running %s hook", hook)
+	}
+	out, err := runCommand(ctx, command, timeout, env.environ(hook))
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			log.Printf("[%s] %s", label, line)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook: %w", hook, err)
+	}
+	return nil
+}
+
+// runCommand runs command with sh -c and the extra environment variables env, killing it after
+// timeout. Returns its combined output.
+func runCommand(ctx context.Context, command string, timeout time.Duration, env []string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	// Don't wait for background processes that inherited the output pipe.
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return out, err
+}
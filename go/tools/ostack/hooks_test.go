@@ -0,0 +1,96 @@
+package ostack
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRunHookEnv(t *testing.T) {
+	tests := []struct {
+		name string
+		hook string
+		env  hookEnv
+		want []string
+	}{
+		{"pre_run", "pre_run", hookEnv{backupDir: "/backup"}, []string{
+			"PROTECT_OSTACK_HOOK=pre_run",
+			"PROTECT_OSTACK_BACKUP_DIR=/backup",
+			"PROTECT_OSTACK_TARGET=offsite",
+		}},
+		{"post_vm", "post_vm", hookEnv{
+			vm:        &VMPair{Name: "vm1", ID: "id1"},
+			backupDir: "/backup/demo",
+			project:   "demo",
+			result:    HookResultFailure,
+			err:       errors.New("volume vol1: boom"),
+		}, []string{
+			"PROTECT_OSTACK_HOOK=post_vm",
+			"PROTECT_OSTACK_BACKUP_DIR=/backup/demo",
+			"PROTECT_OSTACK_VM_NAME=vm1",
+			"PROTECT_OSTACK_VM_ID=id1",
+			"PROTECT_OSTACK_PROJECT=demo",
+			"PROTECT_OSTACK_TARGET=offsite",
+			"PROTECT_OSTACK_RESULT=failure",
+			"PROTECT_OSTACK_ERROR=volume vol1: boom",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "env")
+			cfg := &Config{targetName: "offsite"}
+			if err := runHook(context.Background(), cfg, tt.hook, "env | grep ^PROTECT_OSTACK_ >"+out, tt.env); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.Split(strings.TrimSpace(string(data)), "\n")
+			sort.Strings(got)
+			sort.Strings(tt.want)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hook environment = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunHookFailure(t *testing.T) {
+	ctx := context.Background()
+	if err := runHook(ctx, &Config{}, "pre_vm", "", hookEnv{}); err != nil {
+		t.Errorf("empty hook: %v", err)
+	}
+	err := runHook(ctx, &Config{}, "pre_vm", "exit 3", hookEnv{})
+	if err == nil || !strings.Contains(err.Error(), "pre_vm hook: exit status 3") {
+		t.Errorf("failing hook: err = %v, want exit status 3", err)
+	}
+	cfg := &Config{Hooks: HooksConfig{TimeoutSec: 1}}
+	err = runHook(ctx, cfg, "pre_run", "sleep 5", hookEnv{})
+	if err == nil || !strings.Contains(err.Error(), "timed out after 1s") {
+		t.Errorf("slow hook: err = %v, want timeout", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := runHook(canceled, &Config{}, "post_run", "true", hookEnv{}); err != nil {
+		t.Errorf("post hook after cancel: %v, want it to run", err)
+	}
+}
+
+func TestValidateHooks(t *testing.T) {
+	for policy, wantErr := range map[string]bool{"": false, HookFailureSkip: false, HookFailureContinue: false, "abort": true} {
+		cfg := &Config{Hooks: HooksConfig{OnPreFailure: policy}}
+		if err := ValidateHooks(cfg); (err != nil) != wantErr {
+			t.Errorf("on_pre_failure %q: err = %v, want error %v", policy, err, wantErr)
+		}
+		if got := cfg.Hooks.skipOnPreFailure(); got != (policy != HookFailureContinue) {
+			t.Errorf("on_pre_failure %q: skip = %t", policy, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package ostack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Disk image header magic values.
+var (
+	qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+	vmdkMagic  = []byte{'K', 'D', 'M', 'V'}
+)
+
+const (
+	vdiSignature    = 0xbeda107f
+	vmdkDescriptor  = "# Disk DescriptorFile"
+	imageHeaderSize = 4096
+)
+
+// ImageVirtualSize validates the disk image header at the start of r and returns the
+// virtual disk size in bytes. For raw images the virtual size is fileSize.
+func ImageVirtualSize(r io.Reader, format string, fileSize int64) (int64, error) {
+	if format == "raw" {
+		return fileSize, nil
+	}
+	hdr := make([]byte, imageHeaderSize)
+	n, err := io.ReadFull(r, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("read header: %w", err)
+	}
+	hdr = hdr[:n]
+	switch format {
+	case "qcow2":
+		// magic(4) version(4) backing_file_offset(8) backing_file_size(4) cluster_bits(4) size(8)
+		if len(hdr) < 32 || !bytes.Equal(hdr[:4], qcow2Magic) {
+			return 0, fmt.Errorf("bad qcow2 magic")
+		}
+		if v := binary.BigEndian.Uint32(hdr[4:8]); v != 2 && v != 3 {
+			return 0, fmt.Errorf("unsupported qcow2 version %d", v)
+		}
+		return int64(binary.BigEndian.Uint64(hdr[24:32])), nil
+	case "vmdk":
+		// Sparse extent header: magic(4) version(4) flags(4) capacity in sectors(8)
+		if len(hdr) >= 20 && bytes.Equal(hdr[:4], vmdkMagic) {
+			return int64(binary.LittleEndian.Uint64(hdr[12:20])) * 512, nil
+		}
+		if bytes.HasPrefix(hdr, []byte(vmdkDescriptor)) {
+			return vmdkDescriptorSize(hdr)
+		}
+		return 0, fmt.Errorf("bad vmdk magic")
+	case "vdi":
+		// 64-byte text banner, signature(4) at 0x40, version(4) at 0x44, disk size(8) at 0x170
+		if len(hdr) < 0x178 || binary.LittleEndian.Uint32(hdr[0x40:0x44]) != vdiSignature {
+			return 0, fmt.Errorf("bad vdi signature")
+		}
+		if major := binary.LittleEndian.Uint32(hdr[0x44:0x48]) >> 16; major != 1 {
+			return 0, fmt.Errorf("unsupported vdi version %d", major)
+		}
+		return int64(binary.LittleEndian.Uint64(hdr[0x170:0x178])), nil
+	default:
+		return 0, fmt.Errorf("unsupported disk format: %s", format)
+	}
+}
+
+// vmdkDescriptorSize sums the extent sizes ("RW <sectors> ...") of a text VMDK descriptor.
+func vmdkDescriptorSize(desc []byte) (int64, error) {
+	var sectors int64
+	sc := bufio.NewScanner(bytes.NewReader(desc))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || (fields[0] != "RW" && fields[0] != "RDONLY") {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad vmdk extent line %q", sc.Text())
+		}
+		sectors += n
+	}
+	if sectors == 0 {
+		return 0, fmt.Errorf("no extents in vmdk descriptor")
+	}
+	return sectors * 512, nil
+}
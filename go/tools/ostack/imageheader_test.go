@@ -0,0 +1,81 @@
+package ostack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func qcow2Header(version uint32, size uint64) []byte {
+	h := make([]byte, 72)
+	copy(h, qcow2Magic)
+	binary.BigEndian.PutUint32(h[4:], version)
+	binary.BigEndian.PutUint64(h[24:], size)
+	return h
+}
+
+func vmdkSparseHeader(sectors uint64) []byte {
+	h := make([]byte, 512)
+	copy(h, vmdkMagic)
+	binary.LittleEndian.PutUint32(h[4:], 1)
+	binary.LittleEndian.PutUint64(h[12:], sectors)
+	return h
+}
+
+func vdiHeader(version uint32, size uint64) []byte {
+	h := make([]byte, 512)
+	copy(h, "<<< Oracle VM VirtualBox Disk Image >>>\n")
+	binary.LittleEndian.PutUint32(h[0x40:], vdiSignature)
+	binary.LittleEndian.PutUint32(h[0x44:], version)
+	binary.LittleEndian.PutUint64(h[0x170:], size)
+	return h
+}
+
+func TestImageVirtualSize(t *testing.T) {
+	const gib = 1 << 30
+	descriptor := vmdkDescriptor + "\nversion=1\ncreateType=\"monolithicFlat\"\n\n" +
+		"RW 2097152 FLAT \"disk-flat.vmdk\" 0\nRDONLY 1024 FLAT \"disk-2.vmdk\" 0\n"
+	tests := []struct {
+		name     string
+		format   string
+		data     []byte
+		fileSize int64
+		want     int64
+		wantErr  bool
+	}{
+		{name: "raw uses the file size", format: "raw", data: []byte("anything"), fileSize: 5 * gib, want: 5 * gib},
+		{name: "qcow2 v2", format: "qcow2", data: qcow2Header(2, 10*gib), want: 10 * gib},
+		{name: "qcow2 v3", format: "qcow2", data: qcow2Header(3, 20*gib), want: 20 * gib},
+		{name: "qcow2 bad version", format: "qcow2", data: qcow2Header(4, gib), wantErr: true},
+		{name: "qcow2 bad magic", format: "qcow2", data: vdiHeader(0x00010001, gib), wantErr: true},
+		{name: "qcow2 truncated", format: "qcow2", data: qcow2Header(3, gib)[:20], wantErr: true},
+		{name: "vmdk sparse", format: "vmdk", data: vmdkSparseHeader(2 * gib / 512), want: 2 * gib},
+		{name: "vmdk descriptor", format: "vmdk", data: []byte(descriptor), want: (2097152 + 1024) * 512},
+		{name: "vmdk descriptor without extents", format: "vmdk", data: []byte(vmdkDescriptor + "\nversion=1\n"), wantErr: true},
+		{name: "vmdk bad extent", format: "vmdk", data: []byte(vmdkDescriptor + "\nRW lots FLAT \"x\" 0\n"), wantErr: true},
+		{name: "vmdk bad magic", format: "vmdk", data: qcow2Header(3, gib), wantErr: true},
+		{name: "vdi", format: "vdi", data: vdiHeader(0x00010001, 8*gib), want: 8 * gib},
+		{name: "vdi bad version", format: "vdi", data: vdiHeader(0x00020000, gib), wantErr: true},
+		{name: "vdi bad signature", format: "vdi", data: qcow2Header(3, gib), wantErr: true},
+		{name: "vdi truncated", format: "vdi", data: vdiHeader(0x00010001, gib)[:0x100], wantErr: true},
+		{name: "empty", format: "qcow2", data: nil, wantErr: true},
+		{name: "unsupported format", format: "vhd", data: qcow2Header(3, gib), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ImageVirtualSize(bytes.NewReader(tt.data), tt.format, tt.fileSize)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %d, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package ostack
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ManifestFile is the per-run manifest written into each VM backup directory.
+const ManifestFile = "manifest.json"
+
+// Version is the tool version recorded in manifests (set with -ldflags "-X .../ostack.Version=...").
+var Version = "dev"
+
+// Artifact kinds recorded in a manifest.
+const (
+	ArtifactConfig = "config"
+	ArtifactVolume = "volume"
+	// ArtifactRootDisk is the root-disk.<format> image of an image-booted server's ephemeral root disk.
+	ArtifactRootDisk = "root-disk"
+	// ArtifactCinderBackup is a <volID>.cinder-backup.json record of a backup kept by the Cinder backup service.
+	ArtifactCinderBackup = "cinder-backup"
+)
+
+// Manifest lists every artifact of one VM backup run with its checksum and provenance.
+type Manifest struct {
+	ToolVersion string `json:"tool_version"`
+	VMName      string `json:"vm_name"`
+	VMID        string `json:"vm_id"`
+	DiskFormat  string `json:"disk_format"`
+	// BackupMethod is how volumes were backed up; empty = glance-export.
+	BackupMethod string `json:"backup_method,omitempty"`
+	// Encryption is the client-side cipher applied to every object of the run, if any.
+	Encryption string `json:"encryption,omitempty"`
+	// Compression is the codec applied to volume images, if any.
+	Compression string `json:"compression,omitempty"`
+	// ChunkStore is where the chunks of deduplicated images (<volID>.<format>.chunks) are stored.
+	ChunkStore string     `json:"chunk_store,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Complete   bool       `json:"complete"`
+	Errors     []string   `json:"errors,omitempty"`
+	Artifacts  []Artifact `json:"artifacts"`
+
+	// VolumeID and VolumeName are set for the run of an unattached volume (discover_volumes),
+	// which has no VM.
+	VolumeID   string `json:"volume_id,omitempty"`
+	VolumeName string `json:"volume_name,omitempty"`
+
+	// ProjectID and ProjectName are set for the runs of a multi-project backup (projects).
+	ProjectID   string `json:"project_id,omitempty"`
+	ProjectName string `json:"project_name,omitempty"`
+
+	mu sync.Mutex
+}
+
+// Artifact is one file written by a backup run.
+type Artifact struct {
+	File      string `json:"file"`
+	Kind      string `json:"kind"`
+	SHA256    string `json:"sha256"`
+	SizeBytes int64  `json:"size_bytes"`
+	// Compression is the codec of a compressed file; SHA256 and SizeBytes are of the stored
+	// (compressed) bytes and UncompressedBytes is the size of the image itself.
+	Compression       string            `json:"compression,omitempty"`
+	UncompressedBytes int64             `json:"uncompressed_bytes,omitempty"`
+	Volume            *VolumeProvenance `json:"volume,omitempty"`
+}
+
+// VolumeProvenance records where a volume image came from.
+type VolumeProvenance struct {
+	VolumeID     string    `json:"volume_id"`
+	SizeGB       int       `json:"size_gb"`
+	Device       string    `json:"device,omitempty"`
+	DiskFormat   string    `json:"disk_format,omitempty"`
+	SnapshotID   string    `json:"snapshot_id,omitempty"`
+	TempVolumeID string    `json:"temp_volume_id,omitempty"`
+	ImageID      string    `json:"image_id,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+
+	// SnapshotKept is set when the snapshot was kept in the cloud (snapshot_retention).
+	SnapshotKept bool `json:"snapshot_kept,omitempty"`
+	// GroupSnapshotID is the Cinder group snapshot the volume's snapshot belonged to, if the
+	// VM's volumes were snapshotted together (group_snapshots).
+	GroupSnapshotID string `json:"group_snapshot_id,omitempty"`
+	// Quiesce is how the guest was frozen for the snapshot (freeze-command or guest-agent);
+	// empty = crash-consistent.
+	Quiesce string `json:"quiesce,omitempty"`
+	// Quiesced is set when freeze_command was requested for the volume: false if the guest could
+	// not be frozen, with the freeze or thaw failure in QuiesceError.
+	Quiesced     *bool  `json:"quiesced,omitempty"`
+	QuiesceError string `json:"quiesce_error,omitempty"`
+	// BackupID is the Cinder backup of a cinder-backup volume; an incremental backup
+	// depends on ParentBackupID.
+	BackupID       string `json:"backup_id,omitempty"`
+	Incremental    bool   `json:"incremental,omitempty"`
+	ParentBackupID string `json:"parent_backup_id,omitempty"`
+}
+
+// NewManifest starts a manifest for a VM backup run.
+func NewManifest(vm VMPair, diskFormat string) *Manifest {
+	return &Manifest{
+		ToolVersion: Version,
+		VMName:      vm.Name,
+		VMID:        vm.ID,
+		DiskFormat:  diskFormat,
+		StartedAt:   time.Now().UTC(),
+	}
+}
+
+// Add records artifacts; safe for concurrent use.
+func (m *Manifest) Add(arts ...Artifact) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Artifacts = append(m.Artifacts, arts...)
+}
+
+// AddError records a failure that makes the run incomplete; safe for concurrent use.
+func (m *Manifest) AddError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Errors = append(m.Errors, err.Error())
+}
+
+// Write finalizes the manifest and saves it as manifest.json in dest.
+func (m *Manifest) Write(ctx context.Context, dest Sink) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.FinishedAt = time.Now().UTC()
+	m.Complete = len(m.Errors) == 0
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeObject(ctx, dest, ManifestFile, data)
+}
+
+// ReadManifest loads manifest.json from a VM backup run.
+func ReadManifest(ctx context.Context, src Sink) (*Manifest, error) {
+	data, err := readObject(ctx, src, ManifestFile)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", ManifestFile, err)
+	}
+	return m, nil
+}
+
+// VolumeArtifact returns the volume artifact for the original volume ID, or nil.
+func (m *Manifest) VolumeArtifact(volID string) *Artifact {
+	for i := range m.Artifacts {
+		if a := &m.Artifacts[i]; a.Volume != nil && a.Volume.VolumeID == volID {
+			return a
+		}
+	}
+	return nil
+}
+
+// hashingWriter counts and hashes everything written through it.
+type hashingWriter struct {
+	h hash.Hash
+	n int64
+}
+
+func newHashingWriter() *hashingWriter {
+	return &hashingWriter{h: sha256.New()}
+}
+
+func (w *hashingWriter) Write(p []byte) (int, error) {
+	w.h.Write(p)
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func (w *hashingWriter) Sum() string {
+	return hex.EncodeToString(w.h.Sum(nil))
+}
+
+// ChecksumSuffix is appended to an artifact name for its SHA-256 sidecar file.
+const ChecksumSuffix = ".sha256"
+
+// writeChecksumSidecar writes <file>.sha256 in sha256sum format, so `sha256sum -c` also works.
+func writeChecksumSidecar(ctx context.Context, dest Sink, file, sum string) error {
+	line := sum + "  " + file + "\n"
+	return writeObject(ctx, dest, file+ChecksumSuffix, []byte(line))
+}
+
+// readChecksumSidecar returns the hash stored in <file>.sha256.
+func readChecksumSidecar(ctx context.Context, src Sink, file string) (string, error) {
+	data, err := readObject(ctx, src, file+ChecksumSuffix)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("malformed %s%s", file, ChecksumSuffix)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// writeConfigArtifact writes data and its checksum sidecar to dest and returns its manifest entry.
+func writeConfigArtifact(ctx context.Context, dest Sink, name string, data []byte) (Artifact, error) {
+	if err := writeObject(ctx, dest, name, data); err != nil {
+		return Artifact{}, err
+	}
+	sum := sha256.Sum256(data)
+	art := Artifact{
+		File:      name,
+		Kind:      ArtifactConfig,
+		SHA256:    hex.EncodeToString(sum[:]),
+		SizeBytes: int64(len(data)),
+	}
+	if err := writeChecksumSidecar(ctx, dest, name, art.SHA256); err != nil {
+		return Artifact{}, err
+	}
+	return art, nil
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"path/filepath"
 	"strings"
 
@@ -97,7 +96,8 @@ func matchNameFilter(name, pattern string) bool {
 func DiscoverAllVMs(ctx context.Context, client *gophercloud.ServiceClient, cfg *Config) ([]VMPair, error) {
 	log.Println("Discovering VMs from OpenStack...")
 	var result []VMPair
-	opts := servers.ListOpts{AllTenants: true, Limit: 1000}
+	// A multi-project run lists each project with its own token.
+	opts := servers.ListOpts{AllTenants: len(cfg.Projects) == 0, Limit: 1000}
 	err := servers.List(client, opts).EachPage(ctx, func(ctx context.Context, page pagination.Page) (bool, error) {
 		srvList, err := servers.ExtractServers(page)
 		if err != nil {
@@ -135,37 +135,45 @@ func DiscoverAllVMs(ctx context.Context, client *gophercloud.ServiceClient, cfg
 	return result, nil
 }
 
-// BackupVMConfig writes vm-config.json, vm-tags.json, and vm-metadata.json into backupDir.
-func BackupVMConfig(ctx context.Context, client *gophercloud.ServiceClient, vmID, backupDir string) error {
+// BackupVMConfig writes vm-config.json, vm-tags.json, and vm-metadata.json to dest
+// and returns their manifest entries.
+func BackupVMConfig(ctx context.Context, client *gophercloud.ServiceClient, vmID string, dest Sink) ([]Artifact, error) {
+	var arts []Artifact
+	save := func(name string, data []byte) {
+		art, err := writeConfigArtifact(ctx, dest, name, data)
+		if err != nil {
+			log.Printf("Warning: Failed to save %s: %v", name, err)
+			return
+		}
+		arts = append(arts, art)
+	}
 	log.Println("Backing up VM configuration")
 	s, err := servers.Get(ctx, client, vmID).Extract()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cfgJSON, _ := json.MarshalIndent(map[string]interface{}{"server": s}, "", "  ")
-	if err := os.WriteFile(filepath.Join(backupDir, "vm-config.json"), cfgJSON, 0644); err != nil {
-		log.Printf("Warning: Failed to save VM config: %v", err)
-	}
+	save("vm-config.json", cfgJSON)
 	log.Println("Backing up VM tags")
 	tagList, err := tags.List(ctx, client, vmID).Extract()
 	if err != nil {
-		_ = os.WriteFile(filepath.Join(backupDir, "vm-tags.json"), []byte(`{"tags":[]}`), 0644)
+		save("vm-tags.json", []byte(`{"tags":[]}`))
 		log.Println("No tags found, saved empty tags file")
 	} else {
 		tagsJSON, _ := json.MarshalIndent(map[string]interface{}{"tags": tagList}, "", "  ")
-		_ = os.WriteFile(filepath.Join(backupDir, "vm-tags.json"), tagsJSON, 0644)
+		save("vm-tags.json", tagsJSON)
 		log.Println("VM tags saved to vm-tags.json")
 	}
 	log.Println("Backing up VM metadata")
 	meta, err := servers.Metadata(ctx, client, vmID).Extract()
 	if err != nil {
-		_ = os.WriteFile(filepath.Join(backupDir, "vm-metadata.json"), []byte(`{"metadata":{}}`), 0644)
+		save("vm-metadata.json", []byte(`{"metadata":{}}`))
 		log.Println("No metadata found, saved empty metadata file")
 	} else {
 		metaJSON, _ := json.MarshalIndent(map[string]interface{}{"metadata": meta}, "", "  ")
-		_ = os.WriteFile(filepath.Join(backupDir, "vm-metadata.json"), metaJSON, 0644)
+		save("vm-metadata.json", metaJSON)
 		log.Println("VM metadata saved to vm-metadata.json")
 	}
 	log.Println("VM configuration, tags, and metadata saved")
-	return nil
+	return arts, nil
 }
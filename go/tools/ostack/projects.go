@@ -0,0 +1,201 @@
+package ostack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/identity/v3/projects"
+	"github.com/gophercloud/gophercloud/v2/openstack/identity/v3/tokens"
+	"github.com/gophercloud/gophercloud/v2/pagination"
+)
+
+// AllProjects in projects selects every project the user can access (or, with project_role, every
+// project where the user has that role).
+const AllProjects = "*"
+
+// ValidateProjects checks projects in cfg.
+func ValidateProjects(cfg *Config) error {
+	if len(cfg.Projects) == 0 {
+		if cfg.ProjectRole != "" {
+			return errors.New("project_role needs projects")
+		}
+		return nil
+	}
+	if cfg.AuthType == AuthTypeApplicationCredential {
+		return errors.New("projects: an application credential is bound to one project; use auth_type password or token")
+	}
+	if slices.Contains(cfg.Projects, AllProjects) && len(cfg.Projects) > 1 {
+		return fmt.Errorf("projects: %q cannot be combined with project names", AllProjects)
+	}
+	return nil
+}
+
+// selectProjects returns the projects of cfg.Projects (names or IDs), or all for "*", among the
+// enabled projects provider's user can access.
+func selectProjects(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config) ([]projects.Project, error) {
+	identity, err := openstack.NewIdentityV3(provider, gophercloud.EndpointOpts{})
+	if err != nil {
+		return nil, fmt.Errorf("identity client: %w", err)
+	}
+	var available []projects.Project
+	err = projects.ListAvailable(identity).EachPage(ctx, func(ctx context.Context, page pagination.Page) (bool, error) {
+		list, err := projects.ExtractProjects(page)
+		if err != nil {
+			return false, err
+		}
+		for _, p := range list {
+			if p.Enabled {
+				available = append(available, p)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list projects: %w", err)
+	}
+	if cfg.Projects[0] == AllProjects {
+		slices.SortFunc(available, func(a, b projects.Project) int { return strings.Compare(a.Name, b.Name) })
+		return available, nil
+	}
+	var selected []projects.Project
+	for _, want := range cfg.Projects {
+		var matches []projects.Project
+		for _, p := range available {
+			if p.ID == want || p.Name == want {
+				matches = append(matches, p)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("project %q not found or not accessible", want)
+		case 1:
+			selected = append(selected, matches[0])
+		default:
+			return nil, fmt.Errorf("project name %q matches %d projects in different domains; use its ID", want, len(matches))
+		}
+	}
+	return selected, nil
+}
+
+// projectDirName returns the directory of project p under the backup target: its name, or its
+// ID if the name is not unique among the selected projects or unusable as a path element.
+func projectDirName(p projects.Project, selected []projects.Project) string {
+	if p.Name == "" || strings.ContainsRune(p.Name, '/') || strings.HasPrefix(p.Name, ".") || strings.HasPrefix(p.Name, "_") {
+		return p.ID
+	}
+	for _, o := range selected {
+		if o.ID != p.ID && o.Name == p.Name {
+			return p.ID
+		}
+	}
+	return p.Name
+}
+
+// projectConfig returns a copy of cfg scoped to project p.
+func projectConfig(cfg *Config, p projects.Project) *Config {
+	c := *cfg
+	c.ProjectID, c.Project = p.ID, p.Name
+	c.ProjectDomain, c.ProjectDomainID = "", ""
+	return &c
+}
+
+// hasRole reports whether provider's token carries role (by name or ID).
+func hasRole(provider *gophercloud.ProviderClient, role string) (bool, error) {
+	var roles []tokens.Role
+	var err error
+	switch r := provider.GetAuthResult().(type) {
+	case tokens.CreateResult:
+		roles, err = r.ExtractRoles()
+	case tokens.GetResult:
+		roles, err = r.ExtractRoles()
+	default:
+		return false, errors.New("no token roles")
+	}
+	if err != nil {
+		return false, err
+	}
+	return slices.ContainsFunc(roles, func(r tokens.Role) bool { return r.Name == role || r.ID == role }), nil
+}
+
+// projectResult is the outcome of one project of a multi-project run.
+type projectResult struct {
+	name string
+	// skipped is set when the user lacks project_role in the project.
+	skipped bool
+	err     error
+}
+
+// runProjects backs up each selected project with its own project-scoped token into
+// <sink>/<project>, concurrently and within the shared limits lim. A failed project does not
+// stop the others; the run fails if any project failed.
+func runProjects(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config, sink Sink, lim *runLimits) error {
+	selected, err := selectProjects(ctx, provider, cfg)
+	if err != nil {
+		return err
+	}
+	if len(selected) == 0 {
+		log.Println("No projects found")
+		return nil
+	}
+	log.Printf("Backing up %d project(s)", len(selected))
+	results := make([]projectResult, len(selected))
+	var wg sync.WaitGroup
+	for i, p := range selected {
+		dir := projectDirName(p, selected)
+		results[i].name = dir
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := &results[i]
+			pcfg := projectConfig(cfg, p)
+			pp, err := NewProvider(ctx, pcfg)
+			if err != nil {
+				res.err = fmt.Errorf("auth: %w", err)
+				log.Printf("Warning: Failed to authenticate to project %s: %v", p.Name, err)
+				return
+			}
+			if cfg.ProjectRole != "" {
+				ok, err := hasRole(pp, cfg.ProjectRole)
+				if err != nil {
+					res.err = fmt.Errorf("roles: %w", err)
+					return
+				}
+				if !ok {
+					res.skipped = true
+					log.Printf("Skipping project %s (no %s role)", p.Name, cfg.ProjectRole)
+					return
+				}
+			}
+			log.Printf("==== Project: %s (ID: %s) ====", p.Name, p.ID)
+			if res.err = backupProject(ctx, pp, pcfg, SubSink(sink, dir), lim); res.err != nil {
+				log.Printf("Warning: Project %s failed: %v", p.Name, res.err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var errs []error
+	var done, skipped int
+	for _, r := range results {
+		switch {
+		case r.skipped:
+			skipped++
+		case r.err != nil:
+			errs = append(errs, fmt.Errorf("project %s: %w", r.name, r.err))
+		default:
+			done++
+		}
+	}
+	log.Printf("Projects: %d backed up, %d failed, %d skipped", done, len(errs), skipped)
+	for _, err := range errs {
+		log.Printf("  %v", err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,122 @@
+package ostack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/identity/v3/projects"
+)
+
+func TestProjectDirName(t *testing.T) {
+	selected := []projects.Project{
+		{ID: "p1", Name: "web"},
+		{ID: "p2", Name: "db"},
+		{ID: "p3", Name: "db"},
+		{ID: "p4", Name: "team/a"},
+		{ID: "p5", Name: ".hidden"},
+		{ID: "p6", Name: "_chunks"},
+		{ID: "p7", Name: ""},
+	}
+	want := []string{"web", "p2", "p3", "p4", "p5", "p6", "p7"}
+	for i, p := range selected {
+		if got := projectDirName(p, selected); got != want[i] {
+			t.Errorf("projectDirName(%+v) = %q, want %q", p, got, want[i])
+		}
+	}
+}
+
+func TestProjectConfig(t *testing.T) {
+	cfg := &Config{}
+	cfg.Project, cfg.ProjectID, cfg.ProjectDomain = "admin", "p0", "Default"
+	cfg.Projects = []string{"web"}
+	c := projectConfig(cfg, projects.Project{ID: "p1", Name: "web"})
+	if c.Project != "web" || c.ProjectID != "p1" || c.ProjectDomain != "" || c.ProjectDomainID != "" {
+		t.Errorf("project config scoped to %q/%q in domain %q/%q, want web/p1 without domain", c.Project, c.ProjectID, c.ProjectDomain, c.ProjectDomainID)
+	}
+	if cfg.Project != "admin" || cfg.ProjectID != "p0" {
+		t.Error("projectConfig changed the original config")
+	}
+}
+
+func TestValidateProjects(t *testing.T) {
+	tests := []struct {
+		name     string
+		projects []string
+		role     string
+		authType string
+		wantErr  bool
+	}{
+		{"none", nil, "", AuthTypePassword, false},
+		{"role without projects", nil, "backup", AuthTypePassword, true},
+		{"names", []string{"web", "db"}, "", AuthTypePassword, false},
+		{"all with role", []string{AllProjects}, "backup", AuthTypeToken, false},
+		{"all and a name", []string{AllProjects, "web"}, "", AuthTypePassword, true},
+		{"application credential", []string{"web"}, "", AuthTypeApplicationCredential, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Projects: tt.projects, ProjectRole: tt.role}
+			cfg.AuthType = tt.authType
+			if err := ValidateProjects(cfg); (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelectProjects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/auth/projects" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"projects": [
+			{"id": "p1", "name": "web", "enabled": true},
+			{"id": "p2", "name": "db", "domain_id": "d1", "enabled": true},
+			{"id": "p3", "name": "db", "domain_id": "d2", "enabled": true},
+			{"id": "p4", "name": "old", "enabled": false},
+			{"id": "p5", "name": "app", "enabled": true}
+		]}`)
+	}))
+	defer srv.Close()
+	provider := &gophercloud.ProviderClient{IdentityBase: srv.URL + "/", IdentityEndpoint: srv.URL + "/v3/"}
+
+	tests := []struct {
+		name     string
+		projects []string
+		want     string // project names, in order
+		wantErr  string
+	}{
+		{"all sorted, enabled only", []string{AllProjects}, "app db db web", ""},
+		{"by name and ID", []string{"web", "p3"}, "web db", ""},
+		{"ambiguous name", []string{"db"}, "", "matches 2 projects"},
+		{"disabled", []string{"old"}, "", "not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectProjects(context.Background(), provider, &Config{Projects: tt.projects})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, len(got))
+			for i, p := range got {
+				names[i] = p.Name
+			}
+			if s := strings.Join(names, " "); s != tt.want {
+				t.Errorf("selected %s, want %s", s, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package ostack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+)
+
+// QuiesceMetaKey is the server metadata key that turns quiescing on ("true") or off ("false")
+// for one VM, overriding quiesce in config.
+const QuiesceMetaKey = "protect-ostack:quiesce"
+
+// How a volume's snapshot was quiesced (VolumeProvenance.Quiesce).
+const (
+	// QuiesceFreezeCommand: taken between freeze_command and thaw_command.
+	QuiesceFreezeCommand = "freeze-command"
+	// QuiesceGuestAgent: taken by Nova, which freezes the guest through the QEMU guest agent.
+	QuiesceGuestAgent = "guest-agent"
+)
+
+// defaultQuiesceTimeout bounds each freeze/thaw command when quiesce_timeout_sec is 0.
+const defaultQuiesceTimeout = 60 * time.Second
+
+// quiesceWanted reports whether the VM's snapshots should be quiesced: the server's
+// protect-ostack:quiesce metadata if set, else quiesce from config.
+func quiesceWanted(cfg *Config, srv *servers.Server) bool {
+	v, ok := srv.Metadata[QuiesceMetaKey]
+	if !ok {
+		return cfg.Quiesce
+	}
+	want, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Warning: Invalid %s=%q on %s (want true or false); using quiesce: %t", QuiesceMetaKey, v, srv.Name, cfg.Quiesce)
+		return cfg.Quiesce
+	}
+	return want
+}
+
+// guestAgentQuiesce reports whether Nova can quiesce an image-booted server while snapshotting its
+// root disk: its image must enable the QEMU guest agent (hw_qemu_guest_agent=yes). Nova skips the
+// freeze silently when the agent does not respond, unless the image also sets os_require_quiesce=yes.
+func guestAgentQuiesce(ctx context.Context, imageClient *gophercloud.ServiceClient, srv *servers.Server) bool {
+	imgID := bootImageID(srv)
+	img, err := images.Get(ctx, imageClient, imgID).Extract()
+	if err != nil {
+		log.Printf("Warning: Failed to get image %s of %s; root disk snapshot may not be quiesced: %v", imgID, srv.Name, err)
+		return false
+	}
+	if !imageFlag(img.Properties["hw_qemu_guest_agent"]) {
+		log.Printf("Warning: Image %s of %s does not set hw_qemu_guest_agent=yes; Nova cannot quiesce its root disk snapshot", imgID, srv.Name)
+		return false
+	}
+	if !imageFlag(img.Properties["os_require_quiesce"]) {
+		log.Printf("Image %s of %s does not set os_require_quiesce=yes; Nova snapshots unquiesced if the guest agent does not respond", imgID, srv.Name)
+	}
+	return true
+}
+
+// imageFlag interprets a boolean image property ("yes", "true", ...).
+func imageFlag(v any) bool {
+	s, _ := v.(string)
+	switch strings.ToLower(s) {
+	case "yes", "true", "1", "on":
+		return true
+	}
+	return false
+}
+
+// guestFreezer runs freeze_command and thaw_command of a quiesced VM around its volume snapshots.
+// A nil *guestFreezer does nothing.
+type guestFreezer struct {
+	cfg    *Config
+	vm     VMPair
+	volIDs []string
+	frozen bool
+	// quiesced is set when freeze_command succeeded.
+	quiesced bool
+	// Err is the first freeze or thaw failure.
+	Err error
+}
+
+// newGuestFreezer returns the freezer for vm's volume snapshots.
+func newGuestFreezer(cfg *Config, vm VMPair, volIDs []string) *guestFreezer {
+	return &guestFreezer{cfg: cfg, vm: vm, volIDs: volIDs}
+}
+
+// Freeze runs freeze_command. On failure the error is kept in Err, thaw_command still runs on Thaw
+// (the command may have frozen some filesystems), and the snapshots are taken anyway; record notes
+// the failure in each volume's provenance.
+func (f *guestFreezer) Freeze(ctx context.Context) {
+	if f == nil {
+		return
+	}
+	f.quiesced = false
+	if f.cfg.FreezeCommand == "" {
+		f.Err = errors.New("quiesce: freeze_command is not set")
+		log.Printf("Warning: Quiesce requested for %s but freeze_command is not set; snapshotting without it", f.vm.Name)
+		return
+	}
+	log.Printf("Freezing %s", f.vm.Name)
+	f.frozen = true
+	if err := f.run(ctx, "freeze", f.cfg.FreezeCommand); err != nil {
+		f.Err = fmt.Errorf("quiesce: freeze: %w", err)
+		log.Printf("Warning: Failed to freeze %s (snapshots are crash-consistent only): %v", f.vm.Name, err)
+		return
+	}
+	f.quiesced = true
+}
+
+// Thaw runs thaw_command after a Freeze. It runs even if ctx is canceled.
+func (f *guestFreezer) Thaw(ctx context.Context) {
+	if f == nil || !f.frozen {
+		return
+	}
+	f.frozen = false
+	if f.cfg.ThawCommand == "" {
+		return
+	}
+	if err := f.run(context.WithoutCancel(ctx), "thaw", f.cfg.ThawCommand); err != nil {
+		if f.Err == nil {
+			f.Err = fmt.Errorf("quiesce: thaw: %w", err)
+		}
+		log.Printf("Warning: Failed to thaw %s (check the guest; it may still be frozen): %v", f.vm.Name, err)
+		return
+	}
+	log.Printf("Thawed %s", f.vm.Name)
+}
+
+// Quiesced reports whether the snapshots were taken with the guest frozen.
+func (f *guestFreezer) Quiesced() bool {
+	return f != nil && f.quiesced
+}
+
+// record sets the quiesce provenance of a volume snapshotted with f: whether the guest was frozen,
+// and the freeze or thaw failure if any. A failure does not make the run incomplete; the snapshot
+// is crash-consistent, like one taken without quiesce.
+func (f *guestFreezer) record(p *VolumeProvenance) {
+	if f == nil {
+		return
+	}
+	quiesced := f.quiesced
+	p.Quiesced = &quiesced
+	if quiesced {
+		p.Quiesce = QuiesceFreezeCommand
+	}
+	if f.Err != nil {
+		p.QuiesceError = f.Err.Error()
+	}
+}
+
+// run executes command with sh -c, passing the VM and phase in PROTECT_OSTACK_* variables.
+func (f *guestFreezer) run(ctx context.Context, phase, command string) error {
+	timeout := defaultQuiesceTimeout
+	if f.cfg.QuiesceTimeoutSec > 0 {
+		timeout = time.Duration(f.cfg.QuiesceTimeoutSec) * time.Second
+	}
+	out, err := runCommand(ctx, command, timeout, []string{
+		"PROTECT_OSTACK_PHASE=" + phase,
+		"PROTECT_OSTACK_VM_NAME=" + f.vm.Name,
+		"PROTECT_OSTACK_VM_ID=" + f.vm.ID,
+		"PROTECT_OSTACK_VOLUMES=" + strings.Join(f.volIDs, ","),
+	})
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%s command: %w: %s", phase, err, msg)
+		}
+		return fmt.Errorf("%s command: %w", phase, err)
+	}
+	return nil
+}
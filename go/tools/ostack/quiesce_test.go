@@ -0,0 +1,47 @@
+package ostack
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestGuestFreezerRecord(t *testing.T) {
+	tests := []struct {
+		name         string
+		freeze, thaw string
+		wantQuiesced bool
+		wantQuiesce  string
+		wantErr      string
+	}{
+		{"frozen", "true", "true", true, QuiesceFreezeCommand, ""},
+		{"freeze fails", "echo busy; exit 1", "true", false, "", "quiesce: freeze: freeze command: exit status 1: busy"},
+		{"thaw fails", "true", "exit 2", true, QuiesceFreezeCommand, "quiesce: thaw: thaw command: exit status 2"},
+		{"no freeze command", "", "true", false, "", "quiesce: freeze_command is not set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{FreezeCommand: tt.freeze, ThawCommand: tt.thaw}
+			f := newGuestFreezer(cfg, VMPair{Name: "vm1", ID: "id1"}, []string{"vol1"})
+			f.Freeze(context.Background())
+			f.Thaw(context.Background())
+			p := &VolumeProvenance{}
+			f.record(p)
+			if p.Quiesced == nil || *p.Quiesced != tt.wantQuiesced {
+				t.Errorf("quiesced = %v, want %t", p.Quiesced, tt.wantQuiesced)
+			}
+			if p.Quiesce != tt.wantQuiesce {
+				t.Errorf("quiesce = %q, want %q", p.Quiesce, tt.wantQuiesce)
+			}
+			if !strings.HasPrefix(p.QuiesceError, tt.wantErr) || (tt.wantErr == "") != (p.QuiesceError == "") {
+				t.Errorf("quiesce_error = %q, want %q", p.QuiesceError, tt.wantErr)
+			}
+		})
+	}
+
+	p := &VolumeProvenance{}
+	(*guestFreezer)(nil).record(p)
+	if p.Quiesced != nil || p.Quiesce != "" {
+		t.Errorf("without quiesce: provenance %+v, want no quiesce fields", p)
+	}
+}
@@ -0,0 +1,665 @@
+package ostack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/keypairs"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/tags"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/volumeattach"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/imagedata"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+	"github.com/gophercloud/gophercloud/v2/openstack/networking/v2/networks"
+)
+
+// RestoreOptions overrides values recorded in the backup when rebuilding a VM.
+type RestoreOptions struct {
+	// Name of the new server; defaults to the recorded server name.
+	Name string
+	// Flavor ID; defaults to the recorded flavor.
+	Flavor string
+	// Networks are network IDs; default is to look up the recorded network names in Neutron.
+	Networks []string
+	// BootVolume is the original volume ID of the boot disk; defaults to the first recorded attachment.
+	BootVolume string
+	// FromSnapshot creates volumes from the snapshots kept in the cloud (snapshot_retention) where
+	// the run has one, instead of importing the backup files.
+	FromSnapshot bool
+}
+
+// backupVolumeFile is a <volID>.<format>[.gz|.zst] disk image found in a backup run.
+type backupVolumeFile struct {
+	VolumeID string
+	Format   string
+	Key      string
+	// Size is the stored size; for a compressed file the image is larger.
+	Size int64
+	// Compression is the codec of a compressed file, or "".
+	Compression string
+	// Chunked marks a <volID>.<format>.chunks index of a deduplicated image.
+	Chunked bool
+	// CinderBackup marks a <volID>.cinder-backup.json record of a backup kept by Cinder.
+	CinderBackup bool
+}
+
+// listBackupVolumes returns the volume image files in a VM backup run.
+func listBackupVolumes(ctx context.Context, src Sink) ([]backupVolumeFile, error) {
+	objs, err := src.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var files []backupVolumeFile
+	for _, o := range objs {
+		if strings.Contains(o.Key, "/") {
+			continue
+		}
+		if vf, ok := parseVolumeFile(o); ok {
+			files = append(files, vf)
+		}
+	}
+	return files, nil
+}
+
+// parseVolumeFile recognizes <volID>.<format> object names, optionally with a compression
+// or chunk index suffix, and <volID>.cinder-backup.json records.
+func parseVolumeFile(o ObjectInfo) (backupVolumeFile, bool) {
+	if strings.HasSuffix(o.Key, CinderBackupSuffix) {
+		return backupVolumeFile{
+			VolumeID:     strings.TrimSuffix(path.Base(o.Key), CinderBackupSuffix),
+			Key:          o.Key,
+			Size:         o.Size,
+			CinderBackup: true,
+		}, true
+	}
+	name, codec := splitCompression(o.Key)
+	chunked := strings.HasSuffix(o.Key, ChunkIndexSuffix)
+	if chunked {
+		name, codec = strings.TrimSuffix(o.Key, ChunkIndexSuffix), ""
+	}
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	if !SupportedDiskFormats[ext] {
+		return backupVolumeFile{}, false
+	}
+	return backupVolumeFile{
+		VolumeID:    strings.TrimSuffix(path.Base(name), "."+ext),
+		Format:      ext,
+		Key:         o.Key,
+		Size:        o.Size,
+		Compression: codec,
+		Chunked:     chunked,
+	}, true
+}
+
+// readBackupJSON decodes the object name in src into v. A missing object leaves v unchanged.
+func readBackupJSON(ctx context.Context, src Sink, name string, v interface{}) error {
+	data, err := readObject(ctx, src, name)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			log.Printf("Warning: %s not found in %s", name, src)
+			return nil
+		}
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// restoreBackupVolume creates a new Cinder volume named name from a volume file: a Cinder backup
+// record is restored by the backup service, a disk image is imported through Glance.
+// If snapID is set, the volume is created from that kept snapshot instead, falling back to
+// the file if the snapshot is gone. Returns the new volume ID; on error, the ID of a volume that
+// was created but did not become available, or "".
+func restoreBackupVolume(ctx context.Context, blockClient, imageClient *gophercloud.ServiceClient, cfg *Config, src Sink, vf backupVolumeFile, name string, minSizeGB int, snapID string) (string, error) {
+	if snapID != "" {
+		volID, err := volumeFromSnapshot(ctx, blockClient, cfg, snapID, name, minSizeGB)
+		if err == nil {
+			return volID, nil
+		}
+		if volID != "" {
+			if err := deleteRestoredVolume(ctx, blockClient, cfg, volID); err != nil {
+				log.Printf("Warning: Failed to delete volume %s: %v", volID, err)
+			}
+		}
+		log.Printf("Warning: Failed to restore volume %s from snapshot: %v; using %s/%s", vf.VolumeID, err, src, vf.Key)
+	}
+	if vf.CinderBackup {
+		return restoreCinderBackup(ctx, blockClient, cfg, src, vf, name)
+	}
+	return importVolumeImage(ctx, blockClient, imageClient, cfg, src, vf, name, minSizeGB)
+}
+
+// importVolumeImage uploads a disk image from src to Glance, creates a Cinder volume from it,
+// waits for the volume to become available, and deletes the intermediate image.
+// The volume is at least minSizeGB (e.g. the source volume size from the manifest). Returns the new volume ID,
+// also with the error if the volume was created but did not become available.
+func importVolumeImage(ctx context.Context, blockClient, imageClient *gophercloud.ServiceClient, cfg *Config, src Sink, vf backupVolumeFile, name string, minSizeGB int) (string, error) {
+	timestamp := time.Now().Format("2006-01-02_1504")
+	if vf.Size == 0 {
+		return "", fmt.Errorf("%s/%s is empty", src, vf.Key)
+	}
+	rc, err := openVolumeFile(ctx, cfg, src, &vf)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	log.Printf("Creating image for %s/%s (%s format)", src, vf.Key, vf.Format)
+	img, err := images.Create(ctx, imageClient, images.CreateOpts{
+		Name:            "restore-" + name + "-" + timestamp,
+		DiskFormat:      vf.Format,
+		ContainerFormat: "bare",
+	}).Extract()
+	if err != nil {
+		return "", err
+	}
+	imgID := img.ID
+	defer func() {
+		if err := images.Delete(ctx, imageClient, imgID).ExtractErr(); err != nil {
+			log.Printf("Warning: Failed to delete image %s: %v", imgID, err)
+		} else {
+			log.Printf("Cleaned up image: %s", imgID)
+		}
+	}()
+
+	log.Printf("Uploading %s/%s to image %s", src, vf.Key, imgID)
+	// The upload streams from src and cannot be retried after a 401.
+	ensureToken(ctx, imageClient)
+	if err := imagedata.Upload(ctx, imageClient, imgID, rc).ExtractErr(); err != nil {
+		return "", fmt.Errorf("upload image: %w", err)
+	}
+	if err := waitImageActive(ctx, imageClient, cfg, imgID); err != nil {
+		return "", err
+	}
+
+	size := vf.Size
+	if img, err := images.Get(ctx, imageClient, imgID).Extract(); err == nil {
+		// For a compressed file, the uploaded (decompressed) size is only known to Glance.
+		size = max(size, img.SizeBytes, img.VirtualSize)
+	}
+	sizeGB := int((size + 1<<30 - 1) >> 30)
+	if sizeGB < minSizeGB {
+		sizeGB = minSizeGB
+	}
+	log.Printf("Creating volume %s (%dGB) from image %s", name, sizeGB, imgID)
+	vol, err := volumes.Create(ctx, blockClient, volumes.CreateOpts{
+		Name:    name,
+		Size:    sizeGB,
+		ImageID: imgID,
+	}, nil).Extract()
+	if err != nil {
+		return "", err
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.StatusTimeoutSec)*time.Second)
+	defer cancel()
+	if err := volumes.WaitForStatus(waitCtx, blockClient, vol.ID, "available"); err != nil {
+		return vol.ID, fmt.Errorf("volume %s: %w", vol.ID, err)
+	}
+	log.Printf("Volume %s is available", vol.ID)
+	return vol.ID, nil
+}
+
+// openVolumeFile opens a volume image for reading: decompressed, or reassembled from the
+// chunk store for a chunk index (whose vf.Size is then set to the image size).
+func openVolumeFile(ctx context.Context, cfg *Config, src Sink, vf *backupVolumeFile) (io.ReadCloser, error) {
+	if vf.Chunked {
+		idx, err := readChunkIndex(ctx, src, vf.Key)
+		if err != nil {
+			return nil, err
+		}
+		chunks, err := chunkStoreForRun(ctx, cfg, src)
+		if err != nil {
+			return nil, err
+		}
+		vf.Size = idx.Size
+		log.Printf("Reading %s/%s from chunk store %s (%d chunks)", src, vf.Key, chunks, len(idx.Chunks))
+		return newChunkedReader(ctx, chunks, idx), nil
+	}
+	rc, err := src.Open(ctx, vf.Key)
+	if err != nil {
+		return nil, err
+	}
+	return openDecompressed(rc, vf.Key)
+}
+
+// RestoreVM rebuilds a server from a VM backup run (a BACKUP_DIR/VM/TIMESTAMP path or backup target URL):
+// every volume image is imported into Cinder, then a new server is booted from them
+// with the recorded flavor, networks, security groups, key pair, tags, and metadata.
+// Returns the new server ID. If the restore fails, the volumes (and server) it created are deleted;
+// any that cannot be are listed in the error.
+func RestoreVM(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config, from string, opts RestoreOptions) (serverID string, err error) {
+	computeClient, blockClient, imageClient, err := newServiceClients(provider, cfg)
+	if err != nil {
+		return "", err
+	}
+	src, err := NewSink(ctx, cfg, from)
+	if err != nil {
+		return "", err
+	}
+
+	var recorded struct {
+		Server servers.Server `json:"server"`
+	}
+	if err := readBackupJSON(ctx, src, "vm-config.json", &recorded); err != nil {
+		return "", err
+	}
+	var recordedTags struct {
+		Tags []string `json:"tags"`
+	}
+	if err := readBackupJSON(ctx, src, "vm-tags.json", &recordedTags); err != nil {
+		return "", err
+	}
+	var recordedMeta struct {
+		Metadata map[string]string `json:"metadata"`
+	}
+	if err := readBackupJSON(ctx, src, "vm-metadata.json", &recordedMeta); err != nil {
+		return "", err
+	}
+	srv := recorded.Server
+	manifest, err := ReadManifest(ctx, src)
+	if err != nil {
+		log.Printf("No usable %s in %s (%v); using vm-config.json only", ManifestFile, src, err)
+		manifest = nil
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = srv.Name
+	}
+	if name == "" {
+		return "", fmt.Errorf("no server name in %s/vm-config.json; pass a name", src)
+	}
+	flavor := opts.Flavor
+	if flavor == "" {
+		flavor = recordedFlavorID(srv.Flavor)
+	}
+	if flavor == "" {
+		return "", fmt.Errorf("no flavor recorded in %s/vm-config.json; pass a flavor", src)
+	}
+
+	files, err := listBackupVolumes(ctx, src)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no volume images found in %s", src)
+	}
+	orderBootFirst(files, bootVolumeID(srv, manifest, opts.BootVolume))
+
+	netIDs := opts.Networks
+	if len(netIDs) == 0 {
+		netIDs, err = resolveRecordedNetworks(ctx, provider, cfg, srv.Addresses)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	log.Printf("==== Restoring VM %s from %s ====", name, src)
+	var created []string
+	defer func() {
+		if err == nil || (serverID == "" && len(created) == 0) {
+			return
+		}
+		if left := cleanupRestore(ctx, computeClient, blockClient, cfg, serverID, created); len(left) > 0 {
+			err = fmt.Errorf("%w (left behind, delete manually: %s)", err, strings.Join(left, ", "))
+		} else {
+			serverID = ""
+		}
+	}()
+	var bdm []servers.BlockDevice
+	for i, vf := range files {
+		var snapID string
+		if opts.FromSnapshot {
+			if snapID = keptSnapshotID(manifest, vf.VolumeID); snapID == "" {
+				log.Printf("No snapshot kept for volume %s; using %s/%s", vf.VolumeID, src, vf.Key)
+			}
+		}
+		volID, err := restoreBackupVolume(ctx, blockClient, imageClient, cfg, src, vf, name+"-"+vf.VolumeID, manifestVolumeSize(manifest, vf.VolumeID), snapID)
+		if volID != "" {
+			created = append(created, volID)
+		}
+		if err != nil {
+			return "", fmt.Errorf("volume %s: %w", vf.VolumeID, err)
+		}
+		bootIndex := -1
+		if i == 0 {
+			bootIndex = 0
+			if err := volumes.SetBootable(ctx, blockClient, volID, volumes.BootableOpts{Bootable: true}).ExtractErr(); err != nil {
+				log.Printf("Warning: Failed to mark volume %s bootable: %v", volID, err)
+			}
+		}
+		bdm = append(bdm, servers.BlockDevice{
+			SourceType:      servers.SourceVolume,
+			DestinationType: servers.DestinationVolume,
+			UUID:            volID,
+			BootIndex:       bootIndex,
+		})
+		log.Printf("Restored volume %s as %s", vf.VolumeID, volID)
+	}
+
+	var nets []servers.Network
+	for _, id := range netIDs {
+		nets = append(nets, servers.Network{UUID: id})
+	}
+	createOpts := servers.CreateOpts{
+		Name:             name,
+		FlavorRef:        flavor,
+		AvailabilityZone: srv.AvailabilityZone,
+		SecurityGroups:   recordedSecurityGroups(srv.SecurityGroups),
+		Networks:         nets,
+		Metadata:         recordedMeta.Metadata,
+		BlockDevice:      bdm,
+	}
+	if createOpts.Metadata == nil {
+		createOpts.Metadata = srv.Metadata
+	}
+	log.Printf("Creating server %s (flavor %s)", name, flavor)
+	newSrv, err := servers.Create(ctx, computeClient, keypairs.CreateOptsExt{CreateOptsBuilder: createOpts, KeyName: srv.KeyName}, nil).Extract()
+	if err != nil {
+		return "", fmt.Errorf("create server: %w", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.StatusTimeoutSec)*time.Second)
+	defer cancel()
+	if err := servers.WaitForStatus(waitCtx, computeClient, newSrv.ID, "ACTIVE"); err != nil {
+		return newSrv.ID, fmt.Errorf("server %s: %w", newSrv.ID, err)
+	}
+	log.Printf("Server %s is ACTIVE", newSrv.ID)
+
+	if len(recordedTags.Tags) > 0 {
+		// Server tags require compute microversion 2.26.
+		tagClient := *computeClient
+		tagClient.Microversion = "2.26"
+		if _, err := tags.ReplaceAll(ctx, &tagClient, newSrv.ID, tags.ReplaceAllOpts{Tags: recordedTags.Tags}).Extract(); err != nil {
+			log.Printf("Warning: Failed to restore tags on %s: %v", newSrv.ID, err)
+		} else {
+			log.Printf("Restored %d tag(s)", len(recordedTags.Tags))
+		}
+	}
+	log.Printf("VM %s restored as %s", name, newSrv.ID)
+	return newSrv.ID, nil
+}
+
+// cleanupRestore deletes the server and volumes created by a failed restore, so they are not left
+// in the project. Returns those it could not delete.
+func cleanupRestore(ctx context.Context, computeClient, blockClient *gophercloud.ServiceClient, cfg *Config, serverID string, volIDs []string) []string {
+	var left []string
+	if serverID != "" {
+		if err := deleteServer(ctx, computeClient, cfg, serverID); err != nil {
+			log.Printf("Warning: Failed to delete server %s: %v", serverID, err)
+			// Its volumes stay attached and cannot be deleted either.
+			left = append(left, "server "+serverID)
+			for _, id := range volIDs {
+				left = append(left, "volume "+id)
+			}
+			return left
+		}
+		log.Printf("Cleaned up server: %s", serverID)
+	}
+	for _, id := range volIDs {
+		if err := deleteRestoredVolume(ctx, blockClient, cfg, id); err != nil {
+			log.Printf("Warning: Failed to delete volume %s: %v", id, err)
+			left = append(left, "volume "+id)
+			continue
+		}
+		log.Printf("Cleaned up volume: %s", id)
+	}
+	return left
+}
+
+// deleteServer deletes a server and waits until it is gone, so that its volumes are detached.
+func deleteServer(ctx context.Context, computeClient *gophercloud.ServiceClient, cfg *Config, serverID string) error {
+	err := servers.Delete(ctx, computeClient, serverID).ExtractErr()
+	if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(time.Duration(cfg.StatusTimeoutSec) * time.Second)
+	for time.Now().Before(deadline) {
+		_, err := servers.Get(ctx, computeClient, serverID).Extract()
+		if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(cfg.StatusIntervalSec) * time.Second):
+		}
+	}
+	return fmt.Errorf("timeout waiting for server %s to be deleted", serverID)
+}
+
+// deleteRestoredVolume deletes a volume created by a failed restore, retrying while Cinder refuses
+// because it is still being detached from a deleted server. A volume that no longer exists is not an error.
+func deleteRestoredVolume(ctx context.Context, blockClient *gophercloud.ServiceClient, cfg *Config, volID string) error {
+	deadline := time.Now().Add(time.Duration(cfg.StatusTimeoutSec) * time.Second)
+	for {
+		err := volumes.Delete(ctx, blockClient, volID, volumes.DeleteOpts{}).ExtractErr()
+		if err == nil || gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			return nil
+		}
+		if !gophercloud.ResponseCodeIs(err, http.StatusBadRequest) || !time.Now().Before(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(cfg.StatusIntervalSec) * time.Second):
+		}
+	}
+}
+
+// recordedFlavorID returns the flavor ID (or, for newer microversions, the original name) from a server's flavor field.
+func recordedFlavorID(flavor map[string]interface{}) string {
+	if id, ok := flavor["id"].(string); ok && id != "" {
+		return id
+	}
+	if name, ok := flavor["original_name"].(string); ok {
+		return name
+	}
+	return ""
+}
+
+// recordedSecurityGroups returns the unique security group names of a server.
+func recordedSecurityGroups(groups []map[string]interface{}) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, g := range groups {
+		name, _ := g["name"].(string)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// bootVolumeID returns override if set, otherwise the root disk of an image-booted server, otherwise the
+// volume at the lowest device path in the manifest (e.g. /dev/vda), otherwise the first volume recorded
+// as attached to the server.
+func bootVolumeID(srv servers.Server, manifest *Manifest, override string) string {
+	if override != "" {
+		return override
+	}
+	if manifest != nil {
+		if manifest.VolumeArtifact(RootDiskID) != nil {
+			return RootDiskID
+		}
+		var bootID, bootDev string
+		for _, a := range manifest.Artifacts {
+			if a.Volume == nil || a.Volume.Device == "" {
+				continue
+			}
+			if bootDev == "" || a.Volume.Device < bootDev {
+				bootID, bootDev = a.Volume.VolumeID, a.Volume.Device
+			}
+		}
+		if bootID != "" {
+			return bootID
+		}
+	}
+	if len(srv.AttachedVolumes) > 0 {
+		return srv.AttachedVolumes[0].ID
+	}
+	return ""
+}
+
+// manifestVolumeSize returns the recorded source volume size in GB, or 0 if unknown.
+func manifestVolumeSize(manifest *Manifest, volID string) int {
+	if manifest == nil {
+		return 0
+	}
+	if a := manifest.VolumeArtifact(volID); a != nil {
+		return a.Volume.SizeGB
+	}
+	return 0
+}
+
+// orderBootFirst sorts files by volume ID with the boot volume first.
+func orderBootFirst(files []backupVolumeFile, bootID string) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if (files[i].VolumeID == bootID) != (files[j].VolumeID == bootID) {
+			return files[i].VolumeID == bootID
+		}
+		return files[i].VolumeID < files[j].VolumeID
+	})
+}
+
+// resolveRecordedNetworks maps the network names in a server's addresses to Neutron network IDs.
+func resolveRecordedNetworks(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config, addresses map[string]interface{}) ([]string, error) {
+	if len(addresses) == 0 {
+		return nil, nil
+	}
+	netClient, err := openstack.NewNetworkV2(provider, endpointOpts(cfg, cfg.Region))
+	if err != nil {
+		return nil, fmt.Errorf("network client: %w", err)
+	}
+	names := make([]string, 0, len(addresses))
+	for n := range addresses {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var ids []string
+	for _, n := range names {
+		pages, err := networks.List(netClient, networks.ListOpts{Name: n}).AllPages(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("list networks: %w", err)
+		}
+		found, err := networks.ExtractNetworks(pages)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("network %q not found; pass network IDs explicitly", n)
+		}
+		log.Printf("Network %s -> %s", n, found[0].ID)
+		ids = append(ids, found[0].ID)
+	}
+	return ids, nil
+}
+
+// RestoreVolume imports a single <volID>.<format> backup file (path or backup target URL) as a new Cinder volume named name
+// and, if attachTo is set, attaches it to that server (name or ID). With fromSnapshot, the volume is created
+// from the snapshot the run kept in the cloud, if any. Returns the new volume ID.
+func RestoreVolume(ctx context.Context, provider *gophercloud.ProviderClient, cfg *Config, file, name, attachTo string, fromSnapshot bool) (string, error) {
+	computeClient, blockClient, imageClient, err := newServiceClients(provider, cfg)
+	if err != nil {
+		return "", err
+	}
+	dir, key := splitTarget(file)
+	src, err := NewSink(ctx, cfg, dir)
+	if err != nil {
+		return "", err
+	}
+	vf, err := findVolumeFile(ctx, src, key)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = "restored-" + vf.VolumeID
+	}
+
+	var serverID string
+	if attachTo != "" {
+		serverID, err = GetVMID(ctx, computeClient, attachTo)
+		if err != nil {
+			if !ValidateVM(ctx, computeClient, attachTo) {
+				return "", fmt.Errorf("server %q not found", attachTo)
+			}
+			serverID = attachTo
+		}
+	}
+
+	var minSize int
+	var snapID string
+	if manifest, err := ReadManifest(ctx, src); err == nil {
+		minSize = manifestVolumeSize(manifest, vf.VolumeID)
+		if fromSnapshot {
+			snapID = keptSnapshotID(manifest, vf.VolumeID)
+		}
+	}
+	if fromSnapshot && snapID == "" {
+		log.Printf("No snapshot kept for volume %s; using %s", vf.VolumeID, file)
+	}
+	log.Printf("==== Restoring volume %s from %s ====", name, file)
+	volID, err := restoreBackupVolume(ctx, blockClient, imageClient, cfg, src, vf, name, minSize, snapID)
+	if err != nil {
+		return "", err
+	}
+	if serverID == "" {
+		log.Printf("Volume %s restored as %s", name, volID)
+		return volID, nil
+	}
+
+	log.Printf("Attaching volume %s to server %s", volID, serverID)
+	att, err := volumeattach.Create(ctx, computeClient, serverID, volumeattach.CreateOpts{VolumeID: volID}).Extract()
+	if err != nil {
+		return volID, fmt.Errorf("attach volume %s: %w", volID, err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.StatusTimeoutSec)*time.Second)
+	defer cancel()
+	if err := volumes.WaitForStatus(waitCtx, blockClient, volID, "in-use"); err != nil {
+		return volID, fmt.Errorf("volume %s: %w", volID, err)
+	}
+	log.Printf("Volume %s restored as %s and attached to %s at %s", name, volID, serverID, att.Device)
+	return volID, nil
+}
+
+// findVolumeFile looks up a single volume image object in src.
+func findVolumeFile(ctx context.Context, src Sink, key string) (backupVolumeFile, error) {
+	objs, err := src.List(ctx, key)
+	if err != nil {
+		return backupVolumeFile{}, err
+	}
+	for _, o := range objs {
+		// Accept the name without its compression or chunk index suffix too (vol.qcow2 for vol.qcow2.zst).
+		if name, _ := splitCompression(strings.TrimSuffix(o.Key, ChunkIndexSuffix)); o.Key != key && name != key {
+			continue
+		}
+		vf, ok := parseVolumeFile(o)
+		if !ok {
+			return backupVolumeFile{}, fmt.Errorf("%s: not a volume image (want <volID>.qcow2, .raw, .vmdk, .vdi, or .cinder-backup.json)", key)
+		}
+		return vf, nil
+	}
+	return backupVolumeFile{}, fmt.Errorf("%s/%s: %w", src, key, ErrNotFound)
+}
@@ -0,0 +1,143 @@
+package ostack
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2"
+)
+
+func TestParseVolumeFile(t *testing.T) {
+	tests := []struct {
+		key    string
+		want   backupVolumeFile
+		wantOK bool
+	}{
+		{key: "vm1/ts/vol-1.qcow2", want: backupVolumeFile{VolumeID: "vol-1", Format: "qcow2"}, wantOK: true},
+		{key: "vol-2.raw", want: backupVolumeFile{VolumeID: "vol-2", Format: "raw"}, wantOK: true},
+		{key: "vm1/ts/vol-3.vmdk.gz", want: backupVolumeFile{VolumeID: "vol-3", Format: "vmdk", Compression: CompressionGzip}, wantOK: true},
+		{key: "vm1/ts/vol-4.vdi.zst", want: backupVolumeFile{VolumeID: "vol-4", Format: "vdi", Compression: CompressionZstd}, wantOK: true},
+		{key: "vm1/ts/vol-5.qcow2.chunks", want: backupVolumeFile{VolumeID: "vol-5", Format: "qcow2", Chunked: true}, wantOK: true},
+		{key: "vm1/ts/vol-6.cinder-backup.json", want: backupVolumeFile{VolumeID: "vol-6", CinderBackup: true}, wantOK: true},
+		{key: "vm1/ts/root-disk.qcow2", want: backupVolumeFile{VolumeID: "root-disk", Format: "qcow2"}, wantOK: true},
+		{key: "vm1/ts/vol-1.qcow2.sha256"},
+		{key: "vm1/ts/manifest.json"},
+		{key: "vm1/ts/vm-config.json"},
+		{key: "vm1/ts/vol-7.iso"},
+		{key: "vm1/ts/vol-8.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, ok := parseVolumeFile(ObjectInfo{Key: tt.key, Size: 42})
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			tt.want.Key, tt.want.Size = tt.key, 42
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeCloud serves the Nova and Cinder calls of a failed restore's cleanup.
+type fakeCloud struct {
+	mu    sync.Mutex
+	calls []string
+	// status is the response to each "METHOD /path"; repeated entries are served in order, the
+	// last one from then on. Unlisted requests get 404.
+	status map[string][]int
+}
+
+func (f *fakeCloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	call := r.Method + " " + r.URL.Path
+	f.calls = append(f.calls, call)
+	codes := f.status[call]
+	if len(codes) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	code := codes[0]
+	if len(codes) > 1 {
+		f.status[call] = codes[1:]
+	}
+	if r.Method == http.MethodGet && code == http.StatusOK {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"server": {"id": %q, "status": "ACTIVE"}}`, path.Base(r.URL.Path))
+		return
+	}
+	w.WriteHeader(code)
+}
+
+func TestCleanupRestore(t *testing.T) {
+	tests := []struct {
+		name      string
+		serverID  string
+		status    map[string][]int
+		wantLeft  []string
+		wantCalls []string
+	}{
+		{
+			name:     "server and volumes deleted",
+			serverID: "srv-1",
+			status: map[string][]int{
+				"DELETE /servers/srv-1": {http.StatusNoContent},
+				"GET /servers/srv-1":    {http.StatusOK, http.StatusNotFound},
+				// Cinder refuses while the volume is still detaching.
+				"DELETE /volumes/vol-1": {http.StatusBadRequest, http.StatusAccepted},
+				"DELETE /volumes/vol-2": {http.StatusAccepted},
+			},
+			wantCalls: []string{
+				"DELETE /servers/srv-1", "GET /servers/srv-1", "GET /servers/srv-1",
+				"DELETE /volumes/vol-1", "DELETE /volumes/vol-1", "DELETE /volumes/vol-2",
+			},
+		},
+		{
+			name: "volume that cannot be deleted is reported",
+			status: map[string][]int{
+				"DELETE /volumes/vol-1": {http.StatusAccepted},
+				"DELETE /volumes/vol-2": {http.StatusForbidden},
+			},
+			wantLeft:  []string{"volume vol-2"},
+			wantCalls: []string{"DELETE /volumes/vol-1", "DELETE /volumes/vol-2"},
+		},
+		{
+			name:     "volumes are kept when the server cannot be deleted",
+			serverID: "srv-1",
+			status: map[string][]int{
+				"DELETE /servers/srv-1": {http.StatusForbidden},
+			},
+			wantLeft:  []string{"server srv-1", "volume vol-1", "volume vol-2"},
+			wantCalls: []string{"DELETE /servers/srv-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeCloud{status: tt.status}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+			client := &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: srv.URL + "/"}
+			cfg := &Config{StatusTimeoutSec: 5}
+
+			left := cleanupRestore(context.Background(), client, client, cfg, tt.serverID, []string{"vol-1", "vol-2"})
+			if !reflect.DeepEqual(left, tt.wantLeft) {
+				t.Errorf("left %v, want %v", left, tt.wantLeft)
+			}
+			if !reflect.DeepEqual(f.calls, tt.wantCalls) {
+				t.Errorf("calls %v, want %v", f.calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package ostack
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+)
+
+// RetentionPolicy is a grandfather-father-son policy for the runs under BACKUP_DIR/VM.
+// A run is kept if any rule selects it; all zero keeps everything.
+type RetentionPolicy struct {
+	// KeepLast keeps the N most recent runs.
+	KeepLast int `yaml:"keep_last"`
+	// KeepDaily keeps the newest run of each of the last N days that have a backup.
+	KeepDaily int `yaml:"keep_daily"`
+	// KeepWeekly keeps the newest run of each of the last N ISO weeks that have a backup.
+	KeepWeekly int `yaml:"keep_weekly"`
+	// KeepMonthly keeps the newest run of each of the last N months that have a backup.
+	KeepMonthly int `yaml:"keep_monthly"`
+}
+
+// IsZero reports whether the policy has no rules (keep everything).
+func (p RetentionPolicy) IsZero() bool {
+	return p.KeepLast <= 0 && p.KeepDaily <= 0 && p.KeepWeekly <= 0 && p.KeepMonthly <= 0
+}
+
+func (p RetentionPolicy) String() string {
+	return fmt.Sprintf("last=%d daily=%d weekly=%d monthly=%d", p.KeepLast, p.KeepDaily, p.KeepWeekly, p.KeepMonthly)
+}
+
+// RetentionFor returns the retention policy for a VM: its entry in retention_overrides, else the global keep_* keys.
+func (cfg *Config) RetentionFor(vm string) RetentionPolicy {
+	if p, ok := cfg.RetentionOverrides[vm]; ok {
+		return p
+	}
+	return cfg.RetentionPolicy
+}
+
+// PruneResult lists the run directories kept and removed (or, for a dry run, that would be removed).
+type PruneResult struct {
+	Kept    []string
+	Removed []string
+}
+
+// backupRun is one VM/TIMESTAMP run in a backup target.
+type backupRun struct {
+	Dir  string
+	Time time.Time
+	// Complete is set (by markComplete) when the run's manifest says it completed without errors.
+	Complete bool
+}
+
+// listVMRuns returns the timestamped runs of one VM, newest first.
+func listVMRuns(ctx context.Context, sink Sink, vm string) ([]backupRun, error) {
+	dirs, err := listDirs(ctx, sink, vm)
+	if err != nil {
+		return nil, err
+	}
+	var runs []backupRun
+	for _, d := range dirs {
+		ts, err := time.ParseInLocation(BackupTimeFormat, d, time.Local)
+		if err != nil {
+			continue
+		}
+		runs = append(runs, backupRun{Dir: path.Join(vm, d), Time: ts})
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Time.After(runs[j].Time) })
+	return runs, nil
+}
+
+// markComplete sets Complete on the runs whose manifest records a complete backup. A run without
+// a readable manifest (failed, interrupted, or still running) is incomplete.
+func markComplete(ctx context.Context, sink Sink, runs []backupRun) error {
+	for i := range runs {
+		m, err := ReadManifest(ctx, SubSink(sink, runs[i].Dir))
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case err == nil:
+			runs[i].Complete = m.Complete
+		case errors.Is(err, ErrNotFound):
+		case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+			log.Printf("Warning: %s/%s: %v; treating the run as incomplete", sink, runs[i].Dir, err)
+		default:
+			return fmt.Errorf("%s: %w", runs[i].Dir, err)
+		}
+	}
+	return nil
+}
+
+// selectRetained marks which runs (sorted newest first) the policy keeps. Only complete runs count
+// toward keep_last and the daily/weekly/monthly buckets, so failed runs cannot push out the last good
+// backup. Incomplete runs newer than the newest complete one (including a backup still running) are
+// kept; older incomplete runs are not.
+func selectRetained(runs []backupRun, p RetentionPolicy) []bool {
+	keep := make([]bool, len(runs))
+	for i, r := range runs {
+		if r.Complete {
+			break
+		}
+		keep[i] = true
+	}
+	last := 0
+	for i, r := range runs {
+		if r.Complete && last < p.KeepLast {
+			keep[i] = true
+			last++
+		}
+	}
+	bucket := func(n int, key func(time.Time) string) {
+		seen := map[string]bool{}
+		for i, r := range runs {
+			if len(seen) >= n {
+				return
+			}
+			if !r.Complete {
+				continue
+			}
+			k := key(r.Time)
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			keep[i] = true
+		}
+	}
+	bucket(p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") })
+	bucket(p.KeepWeekly, func(t time.Time) string {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	})
+	bucket(p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") })
+	return keep
+}
+
+// deletePrefix removes every object under prefix.
+func deletePrefix(ctx context.Context, sink Sink, prefix string) error {
+	objs, err := sink.List(ctx, strings.TrimSuffix(prefix, "/")+"/")
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if err := sink.Delete(ctx, o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneVM applies the VM's retention policy to its runs in sink and removes the runs it does not keep,
+// with the Cinder backups they recorded (backup_method: cinder-backup), newest first. Runs holding a
+// Cinder backup that a kept incremental backup depends on are kept too. With a nil blockClient, runs
+// holding Cinder backups are kept. With dryRun, nothing is removed.
+func PruneVM(ctx context.Context, blockClient *gophercloud.ServiceClient, sink Sink, cfg *Config, vm string, dryRun bool) (*PruneResult, error) {
+	policy := cfg.RetentionFor(vm)
+	res := &PruneResult{}
+	if policy.IsZero() {
+		log.Printf("No retention policy for %s; keeping all backups", vm)
+		return res, nil
+	}
+	runs, err := listVMRuns(ctx, sink, vm)
+	if err != nil {
+		return nil, err
+	}
+	if err := markComplete(ctx, sink, runs); err != nil {
+		return nil, err
+	}
+	keep := selectRetained(runs, policy)
+	recs := make([][]CinderBackupRecord, len(runs))
+	for i, r := range runs {
+		if recs[i], err = readCinderRecords(ctx, SubSink(sink, r.Dir)); err != nil {
+			return nil, fmt.Errorf("%s: %w", r.Dir, err)
+		}
+	}
+	if n := keepCinderParents(recs, keep); n > 0 {
+		log.Printf("Keeping %d more run(s) of %s: kept incremental Cinder backups depend on them", n, vm)
+	}
+	for i, r := range runs {
+		if !keep[i] && len(recs[i]) > 0 && blockClient == nil {
+			log.Printf("Warning: Keeping %s/%s: it holds Cinder backups, which need OpenStack credentials to delete", sink, r.Dir)
+			keep[i] = true
+		}
+		if keep[i] {
+			res.Kept = append(res.Kept, r.Dir)
+			continue
+		}
+		res.Removed = append(res.Removed, r.Dir)
+		if dryRun {
+			for _, rec := range recs[i] {
+				log.Printf("Would delete Cinder backup %s (volume %s)", rec.BackupID, rec.VolumeID)
+			}
+			log.Printf("Would remove %s/%s", sink, r.Dir)
+			continue
+		}
+		// Runs are newest first, so an incremental backup is deleted before its parent. The
+		// records go last, so that a failed deletion is retried by the next prune.
+		for _, rec := range recs[i] {
+			if err := deleteCinderBackup(ctx, blockClient, cfg, rec.BackupID); err != nil {
+				return res, fmt.Errorf("remove %s: delete Cinder backup %s: %w", r.Dir, rec.BackupID, err)
+			}
+		}
+		if err := deletePrefix(ctx, sink, r.Dir); err != nil {
+			return res, fmt.Errorf("remove %s: %w", r.Dir, err)
+		}
+		log.Printf("Removed %s/%s", sink, r.Dir)
+	}
+	log.Printf("Pruned %s (%s): kept %d, removed %d", vm, policy, len(res.Kept), len(res.Removed))
+	return res, nil
+}
+
+// Prune applies retention to every VM in sink (or only vm, if set). provider is used to delete the
+// Cinder backups of removed runs; with a nil provider, runs holding Cinder backups are kept.
+func Prune(ctx context.Context, provider *gophercloud.ProviderClient, sink Sink, cfg *Config, vm string, dryRun bool) (*PruneResult, error) {
+	var blockClient *gophercloud.ServiceClient
+	if provider != nil {
+		var err error
+		blockClient, err = openstack.NewBlockStorageV3(provider, endpointOpts(cfg, cfg.Region))
+		if err != nil {
+			return nil, fmt.Errorf("block storage client: %w", err)
+		}
+	}
+	var vms []string
+	if vm != "" {
+		vms = []string{vm}
+	} else {
+		dirs, err := listVMNames(ctx, sink)
+		if err != nil {
+			return nil, err
+		}
+		vms = dirs
+	}
+	total := &PruneResult{}
+	for _, name := range vms {
+		res, err := PruneVM(ctx, blockClient, sink, cfg, name, dryRun)
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", name, err)
+		}
+		total.Kept = append(total.Kept, res.Kept...)
+		total.Removed = append(total.Removed, res.Removed...)
+	}
+	return total, nil
+}
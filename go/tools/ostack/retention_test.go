@@ -0,0 +1,226 @@
+package ostack
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testRuns builds runs, newest first, from "YYYY-MM-DD_HH-MM" timestamps; a trailing "!" marks
+// an incomplete run.
+func testRuns(t *testing.T, specs ...string) []backupRun {
+	t.Helper()
+	var runs []backupRun
+	for _, s := range specs {
+		ts, complete := s, true
+		if s[len(s)-1] == '!' {
+			ts, complete = s[:len(s)-1], false
+		}
+		tm, err := time.ParseInLocation(BackupTimeFormat, ts, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, backupRun{Dir: path.Join("vm1", ts), Time: tm, Complete: complete})
+	}
+	return runs
+}
+
+func keptDirs(runs []backupRun, keep []bool) []string {
+	var dirs []string
+	for i, r := range runs {
+		if keep[i] {
+			dirs = append(dirs, path.Base(r.Dir))
+		}
+	}
+	return dirs
+}
+
+func TestSelectRetained(t *testing.T) {
+	tests := []struct {
+		name   string
+		runs   []string
+		policy RetentionPolicy
+		want   []string
+	}{
+		{
+			name:   "keep last",
+			runs:   []string{"2026-03-03_10-00", "2026-03-02_10-00", "2026-03-01_10-00"},
+			policy: RetentionPolicy{KeepLast: 2},
+			want:   []string{"2026-03-03_10-00", "2026-03-02_10-00"},
+		},
+		{
+			name:   "keep last more than runs",
+			runs:   []string{"2026-03-02_10-00", "2026-03-01_10-00"},
+			policy: RetentionPolicy{KeepLast: 5},
+			want:   []string{"2026-03-02_10-00", "2026-03-01_10-00"},
+		},
+		{
+			name:   "daily keeps the newest run of each day",
+			runs:   []string{"2026-03-03_22-00", "2026-03-03_10-00", "2026-03-02_22-00", "2026-03-02_10-00", "2026-03-01_10-00"},
+			policy: RetentionPolicy{KeepDaily: 2},
+			want:   []string{"2026-03-03_22-00", "2026-03-02_22-00"},
+		},
+		{
+			name: "weekly uses ISO weeks",
+			// 2026-03-01 is a Sunday (week 9); 2026-03-02 starts week 10.
+			runs:   []string{"2026-03-09_10-00", "2026-03-03_10-00", "2026-03-02_10-00", "2026-03-01_10-00", "2026-02-23_10-00"},
+			policy: RetentionPolicy{KeepWeekly: 3},
+			want:   []string{"2026-03-09_10-00", "2026-03-03_10-00", "2026-03-01_10-00"},
+		},
+		{
+			name:   "monthly",
+			runs:   []string{"2026-03-05_10-00", "2026-03-01_10-00", "2026-02-20_10-00", "2026-01-31_10-00", "2025-12-31_10-00"},
+			policy: RetentionPolicy{KeepMonthly: 3},
+			want:   []string{"2026-03-05_10-00", "2026-02-20_10-00", "2026-01-31_10-00"},
+		},
+		{
+			name:   "rules combine",
+			runs:   []string{"2026-03-03_22-00", "2026-03-03_10-00", "2026-03-02_10-00", "2026-02-10_10-00", "2026-01-10_10-00"},
+			policy: RetentionPolicy{KeepLast: 2, KeepDaily: 2, KeepMonthly: 2},
+			want:   []string{"2026-03-03_22-00", "2026-03-03_10-00", "2026-03-02_10-00", "2026-02-10_10-00"},
+		},
+		{
+			name:   "failed runs do not use keep_last slots",
+			runs:   []string{"2026-03-04_10-00", "2026-03-03_10-00!", "2026-03-02_10-00!", "2026-03-01_10-00"},
+			policy: RetentionPolicy{KeepLast: 2},
+			want:   []string{"2026-03-04_10-00", "2026-03-01_10-00"},
+		},
+		{
+			name:   "failed runs do not use daily slots",
+			runs:   []string{"2026-03-03_10-00", "2026-03-02_22-00!", "2026-03-02_10-00", "2026-03-01_10-00!", "2026-02-28_10-00"},
+			policy: RetentionPolicy{KeepDaily: 3},
+			want:   []string{"2026-03-03_10-00", "2026-03-02_10-00", "2026-02-28_10-00"},
+		},
+		{
+			name:   "incomplete runs newer than the last good one are kept",
+			runs:   []string{"2026-03-05_10-00!", "2026-03-04_10-00!", "2026-03-03_10-00", "2026-03-02_10-00"},
+			policy: RetentionPolicy{KeepLast: 1},
+			want:   []string{"2026-03-05_10-00", "2026-03-04_10-00", "2026-03-03_10-00"},
+		},
+		{
+			name:   "no complete run keeps everything",
+			runs:   []string{"2026-03-02_10-00!", "2026-03-01_10-00!"},
+			policy: RetentionPolicy{KeepLast: 1},
+			want:   []string{"2026-03-02_10-00", "2026-03-01_10-00"},
+		},
+		{
+			name:   "no runs",
+			policy: RetentionPolicy{KeepLast: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := testRuns(t, tt.runs...)
+			got := keptDirs(runs, selectRetained(runs, tt.policy))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepCinderParents(t *testing.T) {
+	rec := func(id, parent string) []CinderBackupRecord {
+		return []CinderBackupRecord{{BackupID: id, ParentBackupID: parent}}
+	}
+	tests := []struct {
+		name  string
+		recs  [][]CinderBackupRecord
+		keep  []bool
+		want  []bool
+		added int
+	}{
+		{
+			name:  "chain to the full backup is kept",
+			recs:  [][]CinderBackupRecord{rec("C", "B"), rec("B", "A"), rec("A", "")},
+			keep:  []bool{true, false, false},
+			want:  []bool{true, true, true},
+			added: 2,
+		},
+		{
+			name:  "older chain is not kept",
+			recs:  [][]CinderBackupRecord{rec("D", "C"), rec("C", ""), rec("B", "A"), rec("A", "")},
+			keep:  []bool{true, false, false, false},
+			want:  []bool{true, true, false, false},
+			added: 1,
+		},
+		{
+			name:  "newer runs are not parents",
+			recs:  [][]CinderBackupRecord{rec("B", "A"), rec("A", "")},
+			keep:  []bool{false, true},
+			want:  []bool{false, true},
+			added: 0,
+		},
+		{
+			name:  "parent recorded in no run",
+			recs:  [][]CinderBackupRecord{rec("B", "X"), nil, rec("A", "")},
+			keep:  []bool{true, false, false},
+			want:  []bool{true, false, false},
+			added: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep := slices.Clone(tt.keep)
+			if added := keepCinderParents(tt.recs, keep); added != tt.added {
+				t.Errorf("added %d, want %d", added, tt.added)
+			}
+			if !reflect.DeepEqual(keep, tt.want) {
+				t.Errorf("keep %v, want %v", keep, tt.want)
+			}
+		})
+	}
+}
+
+func TestPruneVM(t *testing.T) {
+	ctx := context.Background()
+	sink := NewFileSink(t.TempDir())
+	for _, r := range testRuns(t, "2026-03-04_10-00", "2026-03-03_10-00!", "2026-03-02_10-00", "2026-03-01_10-00") {
+		data, err := json.Marshal(Manifest{Complete: r.Complete})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeObject(ctx, sink, path.Join(r.Dir, ManifestFile), data); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeObject(ctx, sink, path.Join(r.Dir, "vol.qcow2"), []byte("image")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A run without a manifest (interrupted before writing it) is incomplete.
+	if err := writeObject(ctx, sink, "vm1/2026-02-28_10-00/vol.qcow2", []byte("image")); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{RetentionPolicy: RetentionPolicy{KeepLast: 2}}
+
+	res, err := PruneVM(ctx, nil, sink, cfg, "vm1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRemoved := []string{"vm1/2026-03-03_10-00", "vm1/2026-03-01_10-00", "vm1/2026-02-28_10-00"}
+	if !reflect.DeepEqual(res.Removed, wantRemoved) {
+		t.Errorf("dry run removed %v, want %v", res.Removed, wantRemoved)
+	}
+	if runs, _ := listVMRuns(ctx, sink, "vm1"); len(runs) != 5 {
+		t.Errorf("dry run left %d runs, want 5", len(runs))
+	}
+
+	if _, err := PruneVM(ctx, nil, sink, cfg, "vm1", false); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := listVMRuns(ctx, sink, "vm1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, r := range runs {
+		left = append(left, r.Dir)
+	}
+	if want := []string{"vm1/2026-03-04_10-00", "vm1/2026-03-02_10-00"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("left %v, want %v", left, want)
+	}
+}
@@ -0,0 +1,388 @@
+package ostack
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// S3Config configures s3:// backup targets (AWS S3 or any S3-compatible store such as MinIO).
+type S3Config struct {
+	// Endpoint URL, e.g. https://minio.example.com:9000. Empty = https://s3.amazonaws.com.
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	// AccessKey and SecretKey; when empty, AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY,
+	// MINIO_ROOT_USER/MINIO_ROOT_PASSWORD, or ~/.aws/credentials are used.
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// PartSizeMB is the initial multipart upload part size (min 5); it doubles every 1000 parts to
+	// stay within S3's 10,000 parts. Each upload in flight buffers up to one part.
+	PartSizeMB int `yaml:"part_size_mb"`
+	// PartRetries is how many times a failed part upload is retried.
+	PartRetries int `yaml:"part_retries"`
+	// SSE requests server-side encryption: "" (none), "AES256", or "aws:kms".
+	SSE string `yaml:"sse"`
+	// SSEKMSKeyID is the KMS key for SSE "aws:kms"; empty = the bucket default key.
+	SSEKMSKeyID string `yaml:"sse_kms_key_id"`
+	// Resume continues an incomplete multipart upload of the same key, skipping parts
+	// whose size and MD5 already match, instead of starting over.
+	Resume bool `yaml:"resume"`
+}
+
+const (
+	defaultS3PartSizeMB  = 64
+	minS3PartSizeMB      = 5
+	defaultS3PartRetries = 3
+	// maxS3Parts and maxS3PartSize are S3's limits on a multipart upload.
+	maxS3Parts    = 10000
+	maxS3PartSize = 5 << 30
+	// s3PartGrowEvery is how many parts are uploaded at each part size before it doubles, so
+	// that large images fit in maxS3Parts: 64 MB parts cover about 23 TB.
+	s3PartGrowEvery = 1000
+)
+
+// S3Sink stores artifacts as objects in an S3 bucket under a key prefix.
+type S3Sink struct {
+	core    *minio.Core
+	bucket  string
+	prefix  string
+	cfg     S3Config
+	sse     encrypt.ServerSide
+	partLen int
+}
+
+// NewS3Sink connects to the bucket and prefix of an s3://BUCKET/PREFIX target, using the TLS
+// settings tc.
+func NewS3Sink(cfg S3Config, tc TLSConfig, bucket, prefix string) (*S3Sink, error) {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3 endpoint %q: %w", cfg.Endpoint, err)
+	}
+	var creds *credentials.Credentials
+	if cfg.AccessKey != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+		})
+	}
+	tr, err := tc.Transport()
+	if err != nil {
+		return nil, err
+	}
+	core, err := minio.NewCore(u.Host, &minio.Options{
+		Creds:     creds,
+		Secure:    u.Scheme == "https",
+		Region:    cfg.Region,
+		Transport: tr,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 client: %w", err)
+	}
+
+	s := &S3Sink{core: core, bucket: bucket, prefix: strings.Trim(prefix, "/"), cfg: cfg}
+	switch strings.ToLower(cfg.SSE) {
+	case "":
+	case "aes256":
+		s.sse = encrypt.NewSSE()
+	case "aws:kms":
+		s.sse, err = encrypt.NewSSEKMS(cfg.SSEKMSKeyID, nil)
+		if err != nil {
+			return nil, fmt.Errorf("s3 sse: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported s3 sse %q (supported: AES256, aws:kms)", cfg.SSE)
+	}
+	partMB := cfg.PartSizeMB
+	if partMB == 0 {
+		partMB = defaultS3PartSizeMB
+	}
+	if partMB < minS3PartSizeMB || partMB > maxS3PartSize>>20 {
+		return nil, fmt.Errorf("s3 part_size_mb must be between %d and %d", minS3PartSizeMB, maxS3PartSize>>20)
+	}
+	s.partLen = partMB << 20
+	if s.cfg.PartRetries == 0 {
+		s.cfg.PartRetries = defaultS3PartRetries
+	}
+	return s, nil
+}
+
+func (s *S3Sink) key(k string) string {
+	if s.prefix == "" {
+		return k
+	}
+	return s.prefix + "/" + k
+}
+
+// Create streams key as a multipart upload; objects smaller than one part are uploaded with a single PUT on Close.
+func (s *S3Sink) Create(ctx context.Context, key string) (SinkWriter, error) {
+	return &s3Writer{ctx: ctx, s: s, key: s.key(key), partLen: s.partLen}, nil
+}
+
+func (s *S3Sink) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, _, _, err := s.core.GetObject(ctx, s.bucket, s.key(key), minio.GetObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return nil, err
+	}
+	return rc, nil
+}
+
+func (s *S3Sink) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objs []ObjectInfo
+	full := s.key(prefix)
+	for o := range s.core.Client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: full, Recursive: true}) {
+		if o.Err != nil {
+			return nil, o.Err
+		}
+		key := o.Key
+		if s.prefix != "" {
+			key = strings.TrimPrefix(key, s.prefix+"/")
+		}
+		objs = append(objs, ObjectInfo{Key: key, Size: o.Size})
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Key < objs[j].Key })
+	return objs, nil
+}
+
+func (s *S3Sink) Delete(ctx context.Context, key string) error {
+	return s.core.Client.RemoveObject(ctx, s.bucket, s.key(key), minio.RemoveObjectOptions{})
+}
+
+func (s *S3Sink) String() string {
+	if s.prefix == "" {
+		return "s3://" + s.bucket
+	}
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// s3Writer buffers one part at a time and uploads full parts as they fill. The buffer grows
+// with the data written, so small objects (manifests, sidecars, chunks) do not hold a whole part.
+type s3Writer struct {
+	ctx      context.Context
+	s        *S3Sink
+	key      string
+	buf      []byte
+	partLen  int
+	uploadID string
+	existing map[int]minio.ObjectPart
+	parts    []minio.CompletePart
+	done     bool
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		c := min(len(p), w.partLen-len(w.buf))
+		w.grow(c)
+		w.buf = append(w.buf, p[:c]...)
+		p = p[c:]
+		n += c
+		if len(w.buf) == w.partLen {
+			if err := w.flushPart(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// grow makes room for n more bytes in the buffer, doubling it but never beyond one part.
+func (w *s3Writer) grow(n int) {
+	if len(w.buf)+n <= cap(w.buf) {
+		return
+	}
+	size := min(max(2*cap(w.buf), len(w.buf)+n, 64<<10), w.partLen)
+	buf := make([]byte, len(w.buf), size)
+	copy(buf, w.buf)
+	w.buf = buf
+}
+
+// flushPart uploads the buffered data as the next part, starting (or resuming) the multipart upload if needed.
+// Every s3PartGrowEvery parts the part size doubles, up to maxS3PartSize.
+func (w *s3Writer) flushPart() error {
+	num := len(w.parts) + 1
+	if num > maxS3Parts {
+		return fmt.Errorf("upload %s: object exceeds S3's limit of %d parts; increase s3.part_size_mb", w.key, maxS3Parts)
+	}
+	if w.uploadID == "" {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	md5sum := md5.Sum(w.buf)
+	if p, ok := w.existing[num]; ok && p.Size == int64(len(w.buf)) && strings.Trim(p.ETag, `"`) == hex.EncodeToString(md5sum[:]) {
+		w.addPart(num, p.ETag)
+		return nil
+	}
+	var err error
+	for attempt := 0; attempt <= w.s.cfg.PartRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("Retrying part %d of %s (attempt %d): %v", num, w.key, attempt+1, err)
+		}
+		var part minio.ObjectPart
+		part, err = w.s.core.PutObjectPart(w.ctx, w.s.bucket, w.key, w.uploadID, num,
+			bytes.NewReader(w.buf), int64(len(w.buf)), minio.PutObjectPartOptions{
+				Md5Base64: base64.StdEncoding.EncodeToString(md5sum[:]),
+				Sha256Hex: sha256Hex(w.buf),
+				SSE:       w.s.sse,
+				// The payload hash is known, so sign it instead of streaming chunked signatures.
+				DisableContentSha256: true,
+			})
+		if err == nil {
+			w.addPart(num, part.ETag)
+			return nil
+		}
+		if w.ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("upload part %d of %s: %w", num, w.key, err)
+}
+
+// addPart records part num as uploaded and empties the buffer for the next part.
+func (w *s3Writer) addPart(num int, etag string) {
+	w.parts = append(w.parts, minio.CompletePart{PartNumber: num, ETag: etag})
+	w.buf = w.buf[:0]
+	if num%s3PartGrowEvery == 0 && w.partLen < maxS3PartSize {
+		w.partLen = min(2*w.partLen, maxS3PartSize)
+		log.Printf("%s: %d parts uploaded; part size raised to %d MB", w.key, num, w.partLen>>20)
+	}
+}
+
+// start begins a multipart upload, or with Resume picks up the newest incomplete upload of the same key.
+func (w *s3Writer) start() error {
+	if w.s.cfg.Resume {
+		if id, parts, err := w.findIncomplete(); err != nil {
+			log.Printf("Warning: cannot list incomplete uploads of %s: %v", w.key, err)
+		} else if id != "" {
+			log.Printf("Resuming multipart upload of %s (%d part(s) already uploaded)", w.key, len(parts))
+			w.uploadID, w.existing = id, parts
+			return nil
+		}
+	}
+	id, err := w.s.core.NewMultipartUpload(w.ctx, w.s.bucket, w.key, w.putOpts())
+	if err != nil {
+		return fmt.Errorf("start multipart upload of %s: %w", w.key, err)
+	}
+	w.uploadID = id
+	return nil
+}
+
+func (w *s3Writer) findIncomplete() (string, map[int]minio.ObjectPart, error) {
+	res, err := w.s.core.ListMultipartUploads(w.ctx, w.s.bucket, w.key, "", "", "", 1000)
+	if err != nil {
+		return "", nil, err
+	}
+	var latest *minio.ObjectMultipartInfo
+	for i, u := range res.Uploads {
+		if u.Key == w.key && (latest == nil || u.Initiated.After(latest.Initiated)) {
+			latest = &res.Uploads[i]
+		}
+	}
+	if latest == nil {
+		return "", nil, nil
+	}
+	parts := map[int]minio.ObjectPart{}
+	marker := 0
+	for {
+		lp, err := w.s.core.ListObjectParts(w.ctx, w.s.bucket, w.key, latest.UploadID, marker, 1000)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, p := range lp.ObjectParts {
+			parts[p.PartNumber] = p
+		}
+		if !lp.IsTruncated {
+			break
+		}
+		marker = lp.NextPartNumberMarker
+	}
+	return latest.UploadID, parts, nil
+}
+
+func (w *s3Writer) putOpts() minio.PutObjectOptions {
+	return minio.PutObjectOptions{ServerSideEncryption: w.s.sse, DisableContentSha256: true}
+}
+
+func (w *s3Writer) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.uploadID == "" {
+		md5sum := md5.Sum(w.buf)
+		_, err := w.s.core.PutObject(w.ctx, w.s.bucket, w.key, bytes.NewReader(w.buf), int64(len(w.buf)),
+			base64.StdEncoding.EncodeToString(md5sum[:]), sha256Hex(w.buf), w.putOpts())
+		if err != nil {
+			return fmt.Errorf("put %s: %w", w.key, err)
+		}
+		return nil
+	}
+	if len(w.buf) > 0 {
+		if err := w.flushPart(); err != nil {
+			w.abortAfter(err)
+			return err
+		}
+	}
+	if _, err := w.s.core.CompleteMultipartUpload(w.ctx, w.s.bucket, w.key, w.uploadID, w.parts, w.putOpts()); err != nil {
+		w.abortAfter(err)
+		return fmt.Errorf("complete multipart upload of %s: %w", w.key, err)
+	}
+	return nil
+}
+
+// Abort cancels the multipart upload. With Resume, the incomplete upload is kept so a later run can continue it.
+func (w *s3Writer) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	return w.abortUpload()
+}
+
+// abortAfter aborts the upload after Close failed with err; the abort error is only logged.
+func (w *s3Writer) abortAfter(err error) {
+	if aerr := w.abortUpload(); aerr != nil {
+		log.Printf("Warning: cannot abort multipart upload of %s after %v: %v", w.key, err, aerr)
+	}
+}
+
+// abortUpload cancels the multipart upload, if one was started, so the store frees (and stops
+// billing) its uploaded parts. With Resume, the incomplete upload is kept instead.
+func (w *s3Writer) abortUpload() error {
+	if w.uploadID == "" || w.s.cfg.Resume {
+		return nil
+	}
+	return w.s.core.AbortMultipartUpload(context.Background(), w.s.bucket, w.key, w.uploadID)
+}
+
+// sha256Hex is the payload hash sent with each PUT of a buffered part.
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,321 @@
+package ostack
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// fakeS3 is an in-memory S3 endpoint with just the object and multipart calls the sink uses.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]*fakeUpload
+	nextID  int
+	// partPuts counts uploaded parts; sse records the encryption header of each object PUT and
+	// multipart upload start (S3 takes it there, not on the parts).
+	partPuts int
+	sse      []string
+	aborts   int
+	// failPart and failComplete reject a part number or the completion of an upload.
+	failPart     int
+	failComplete bool
+}
+
+type fakeUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: map[string][]byte{}, uploads: map[string]*fakeUpload{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func etagOf(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+	_, uploads := q["uploads"]
+	id := q.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && uploads:
+		f.sse = append(f.sse, r.Header.Get("X-Amz-Server-Side-Encryption"))
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = &fakeUpload{key: key, initiated: time.Now().Add(time.Duration(f.nextID) * time.Second), parts: map[int][]byte{}}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, id)
+	case r.Method == http.MethodGet && uploads:
+		res := minio.ListMultipartUploadsResult{Bucket: bucket}
+		for id, u := range f.uploads {
+			if strings.HasPrefix(u.key, q.Get("prefix")) {
+				res.Uploads = append(res.Uploads, minio.ObjectMultipartInfo{Key: u.key, UploadID: id, Initiated: u.initiated})
+			}
+		}
+		xml.NewEncoder(w).Encode(res)
+	case id != "" && f.uploads[id] == nil:
+		s3Error(w, http.StatusNotFound, "NoSuchUpload")
+	case r.Method == http.MethodPut && id != "":
+		num, _ := strconv.Atoi(q.Get("partNumber"))
+		if num == f.failPart {
+			s3Error(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		f.partPuts++
+		f.uploads[id].parts[num] = body
+		w.Header().Set("ETag", etagOf(body))
+	case r.Method == http.MethodGet && id != "":
+		res := minio.ListObjectPartsResult{Bucket: bucket, Key: key, UploadID: id}
+		for num, p := range f.uploads[id].parts {
+			res.ObjectParts = append(res.ObjectParts, minio.ObjectPart{PartNumber: num, ETag: etagOf(p), Size: int64(len(p))})
+		}
+		sort.Slice(res.ObjectParts, func(i, j int) bool { return res.ObjectParts[i].PartNumber < res.ObjectParts[j].PartNumber })
+		xml.NewEncoder(w).Encode(res)
+	case r.Method == http.MethodPost && id != "":
+		if f.failComplete {
+			s3Error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		var req struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &req); err != nil {
+			s3Error(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var data []byte
+		for _, p := range req.Parts {
+			part, ok := f.uploads[id].parts[p.PartNumber]
+			if !ok || strings.Trim(p.ETag, `"`) != strings.Trim(etagOf(part), `"`) {
+				s3Error(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, part...)
+		}
+		f.objects[key] = data
+		delete(f.uploads, id)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>\"x\"</ETag></CompleteMultipartUploadResult>", bucket, key)
+	case r.Method == http.MethodDelete && id != "":
+		f.aborts++
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.sse = append(f.sse, r.Header.Get("X-Amz-Server-Side-Encryption"))
+		f.objects[key] = body
+		w.Header().Set("ETag", etagOf(body))
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("ETag", etagOf(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Write(data)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// newTestS3Sink returns a sink on the fake with partKB-sized parts (below S3's 5 MB minimum,
+// to keep the tests small).
+func newTestS3Sink(t *testing.T, srv *httptest.Server, cfg S3Config, partKB int) *S3Sink {
+	t.Helper()
+	cfg.Endpoint, cfg.Region, cfg.AccessKey, cfg.SecretKey = srv.URL, "us-east-1", "key", "secret"
+	s, err := NewS3Sink(cfg, TLSConfig{}, "bucket", "prefix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.partLen = partKB << 10
+	return s
+}
+
+func TestS3SinkRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		size      int
+		wantParts int
+	}{
+		{"empty", 0, 0},
+		{"below one part", 10<<10 - 1, 0},
+		{"one part", 10 << 10, 1},
+		{"several parts", 35 << 10, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, srv := newFakeS3(t)
+			s := newTestS3Sink(t, srv, S3Config{SSE: "AES256"}, 10)
+			data := randomData(int64(tt.size), tt.size)
+			if err := writeObject(ctx, s, "vm1/obj", data); err != nil {
+				t.Fatal(err)
+			}
+			if f.partPuts != tt.wantParts {
+				t.Errorf("%d parts uploaded, want %d", f.partPuts, tt.wantParts)
+			}
+			if !bytes.Equal(f.objects["prefix/vm1/obj"], data) {
+				t.Errorf("stored %d bytes, want %d", len(f.objects["prefix/vm1/obj"]), len(data))
+			}
+			if len(f.sse) != 1 {
+				t.Errorf("%d object or upload creations, want 1", len(f.sse))
+			}
+			for i, h := range f.sse {
+				if h != "AES256" {
+					t.Errorf("request %d: server-side encryption header %q, want AES256", i, h)
+				}
+			}
+			got, err := readObject(ctx, s, "vm1/obj")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestNewS3SinkOptions(t *testing.T) {
+	_, srv := newFakeS3(t)
+	tests := []struct {
+		name    string
+		cfg     S3Config
+		wantErr bool
+	}{
+		{"defaults", S3Config{}, false},
+		{"kms", S3Config{SSE: "aws:kms", SSEKMSKeyID: "key-1"}, false},
+		{"unknown sse", S3Config{SSE: "rot13"}, true},
+		{"part too small", S3Config{PartSizeMB: 4}, true},
+		{"part too large", S3Config{PartSizeMB: 5121}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Endpoint = srv.URL
+			_, err := NewS3Sink(tt.cfg, TLSConfig{}, "bucket", "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestS3WriterPartGrowth(t *testing.T) {
+	w := &s3Writer{key: "obj", partLen: 5 << 20}
+	sizes := map[int]int{}
+	for num := 1; num <= 3*s3PartGrowEvery; num++ {
+		sizes[num] = w.partLen
+		w.addPart(num, "etag")
+	}
+	for num, want := range map[int]int{1: 5 << 20, s3PartGrowEvery: 5 << 20, s3PartGrowEvery + 1: 10 << 20, 2*s3PartGrowEvery + 1: 20 << 20} {
+		if sizes[num] != want {
+			t.Errorf("part %d has size %d, want %d", num, sizes[num], want)
+		}
+	}
+
+	w = &s3Writer{key: "obj", partLen: maxS3PartSize / 2}
+	for num := 1; num <= 2*s3PartGrowEvery; num++ {
+		w.addPart(num, "etag")
+	}
+	if w.partLen != maxS3PartSize {
+		t.Errorf("part size %d, want the %d maximum", w.partLen, maxS3PartSize)
+	}
+
+	w.parts = make([]minio.CompletePart, maxS3Parts)
+	if err := w.flushPart(); err == nil || !strings.Contains(err.Error(), "parts") {
+		t.Errorf("flushPart beyond %d parts: err = %v, want part limit error", maxS3Parts, err)
+	}
+}
+
+func TestS3WriterCloseAborts(t *testing.T) {
+	tests := []struct {
+		name         string
+		failPart     int
+		failComplete bool
+	}{
+		{"last part fails", 3, false},
+		{"completion fails", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, srv := newFakeS3(t)
+			f.failPart, f.failComplete = tt.failPart, tt.failComplete
+			s := newTestS3Sink(t, srv, S3Config{}, 10)
+			if err := writeObject(context.Background(), s, "obj", randomData(1, 25<<10)); err == nil {
+				t.Fatal("write succeeded, want error")
+			}
+			if f.aborts != 1 || len(f.uploads) != 0 {
+				t.Errorf("%d aborts, %d uploads left, want the upload aborted", f.aborts, len(f.uploads))
+			}
+		})
+	}
+}
+
+func TestS3WriterResume(t *testing.T) {
+	ctx := context.Background()
+	f, srv := newFakeS3(t)
+	s := newTestS3Sink(t, srv, S3Config{Resume: true}, 10)
+	data := randomData(2, 45<<10)
+
+	f.failPart = 4
+	if err := writeObject(ctx, s, "obj", data); err == nil {
+		t.Fatal("first write succeeded, want error")
+	}
+	if f.aborts != 0 || len(f.uploads) != 1 {
+		t.Fatalf("%d aborts, %d uploads left, want the upload kept for resume", f.aborts, len(f.uploads))
+	}
+
+	f.failPart, f.partPuts = 0, 0
+	// Change part 2 so that it no longer matches and is uploaded again.
+	for _, u := range f.uploads {
+		u.parts[2] = []byte("stale")
+	}
+	if err := writeObject(ctx, s, "obj", data); err != nil {
+		t.Fatal(err)
+	}
+	if f.partPuts != 3 {
+		t.Errorf("%d parts uploaded on resume, want 3 (parts 2, 4, and 5)", f.partPuts)
+	}
+	if !bytes.Equal(f.objects["prefix/obj"], data) {
+		t.Error("resumed object differs from the data written")
+	}
+}
@@ -0,0 +1,126 @@
+package ostack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// passwordCommandTimeout bounds password_command.
+const passwordCommandTimeout = 30 * time.Second
+
+// redactedValue replaces secrets in Redacted.
+const redactedValue = "<redacted>"
+
+// hasPasswordSource reports whether a password_file, password_env, or password_command is set.
+func (a AuthConfig) hasPasswordSource() bool {
+	return a.PasswordFile != "" || a.PasswordEnv != "" || a.PasswordCommand != ""
+}
+
+// resolvePassword sets cfg.Password from password_file, password_env, or password_command (the
+// first that is set) when no password is given directly. password_command runs with sh -c; its
+// standard output, without the trailing newline, is the password.
+func resolvePassword(ctx context.Context, cfg *Config) error {
+	a := &cfg.AuthConfig
+	if a.AuthType != "" && a.AuthType != AuthTypePassword || a.Password != "" || !a.hasPasswordSource() {
+		return nil
+	}
+	var pw string
+	switch {
+	case a.PasswordFile != "":
+		data, err := os.ReadFile(a.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("password_file: %w", err)
+		}
+		pw = string(data)
+	case a.PasswordEnv != "":
+		v, ok := os.LookupEnv(a.PasswordEnv)
+		if !ok || v == "" {
+			return fmt.Errorf("password_env: environment variable %s is not set", a.PasswordEnv)
+		}
+		pw = v
+	default:
+		ctx, cancel := context.WithTimeout(ctx, passwordCommandTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "sh", "-c", a.PasswordCommand)
+		// Only stdout is the password; the command's messages go to our stderr.
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("timed out after %s", passwordCommandTimeout)
+			}
+			return fmt.Errorf("password_command: %w", err)
+		}
+		pw = string(out)
+	}
+	pw = strings.TrimRight(pw, "\r\n")
+	if pw == "" {
+		return errors.New("password source returned an empty password")
+	}
+	a.Password = pw
+	return nil
+}
+
+// hasSecrets reports whether cfg, or one of its targets, holds a password, secret, or token.
+func (c *Config) hasSecrets() bool {
+	if c.Password != "" || c.ApplicationCredentialSecret != "" || c.Token != "" ||
+		c.S3.SecretKey != "" || c.Swift.Password != "" {
+		return true
+	}
+	return slices.ContainsFunc(c.Targets, TargetConfig.hasSecrets)
+}
+
+// checkConfigPermissions refuses a config file that holds secrets and is readable by any user,
+// and warns if it is readable by its group.
+func checkConfigPermissions(path string, cfg *Config) error {
+	if !cfg.hasSecrets() {
+		return nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	mode := fi.Mode().Perm()
+	switch {
+	case mode&0o004 != 0:
+		return fmt.Errorf("%s holds secrets but is readable by all users (mode %04o); run chmod 600 %s or use password_file, password_env, or password_command", path, mode, path)
+	case mode&0o040 != 0:
+		log.Printf("Warning: %s holds secrets but is readable by its group (mode %04o); consider chmod 600", path, mode)
+	}
+	return nil
+}
+
+// Redacted returns a copy of c with passwords, secrets, and tokens replaced by <redacted>, for
+// logging or printing the configuration.
+func (c Config) Redacted() Config {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = redactedValue
+		}
+	}
+	redact(&c.Password)
+	redact(&c.ApplicationCredentialSecret)
+	redact(&c.Token)
+	redact(&c.S3.SecretKey)
+	redact(&c.Swift.Password)
+	return c
+}
+
+// String returns the configuration as YAML with secrets redacted, so that a logged Config
+// never shows them.
+func (c Config) String() string {
+	data, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return fmt.Sprintf("<config: %v>", err)
+	}
+	return string(data)
+}
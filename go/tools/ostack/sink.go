@@ -0,0 +1,247 @@
+package ostack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by Sink.Open for a missing key.
+var ErrNotFound = errors.New("not found")
+
+// Sink stores backup artifacts under slash-separated keys such as "vm1/2026-01-27_14-30/vm-config.json".
+// The backup target (backup_target in config) selects the implementation.
+type Sink interface {
+	// Create opens key for writing. The object is committed by Close; Abort discards it.
+	Create(ctx context.Context, key string) (SinkWriter, error)
+	// Open reads key. Returns an error wrapping ErrNotFound if it does not exist.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns every object whose key starts with prefix, sorted by key.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Delete removes key.
+	Delete(ctx context.Context, key string) error
+	// String describes the sink location for logs.
+	String() string
+}
+
+// SinkWriter is an object being written to a Sink.
+type SinkWriter interface {
+	io.WriteCloser
+	// Abort discards everything written so far. Calling Close after Abort is a no-op.
+	Abort() error
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
+// NewSink returns the sink for a backup target: a local path or file:// URL (default),
+// s3://BUCKET/PREFIX, or swift://CONTAINER/PREFIX. With encryption configured,
+// objects are encrypted on write and decrypted on read.
+func NewSink(ctx context.Context, cfg *Config, target string) (Sink, error) {
+	s, err := newStorageSink(ctx, cfg, target)
+	if err != nil || !cfg.Encryption.Enabled() {
+		return s, err
+	}
+	key, err := LoadEncryptionKey(cfg.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptSink(s, key), nil
+}
+
+// newStorageSink returns the unwrapped storage backend for target.
+func newStorageSink(ctx context.Context, cfg *Config, target string) (Sink, error) {
+	if !strings.Contains(target, "://") {
+		return NewFileSink(target), nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("parse backup target %q: %w", target, err)
+	}
+	switch u.Scheme {
+	case "file":
+		return NewFileSink(u.Path), nil
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("backup target %q: missing bucket", target)
+		}
+		return NewS3Sink(cfg.S3, cfg.TLS, u.Host, u.Path)
+	case "swift":
+		if u.Host == "" {
+			return nil, fmt.Errorf("backup target %q: missing container", target)
+		}
+		return NewSwiftSink(ctx, cfg, u.Host, u.Path)
+	default:
+		return nil, fmt.Errorf("unsupported backup target scheme %q (supported: file, s3, swift)", u.Scheme)
+	}
+}
+
+// Target returns cfg.BackupTarget, or cfg.BackupDir when no target is configured.
+func (cfg *Config) Target() string {
+	if cfg.BackupTarget != "" {
+		return cfg.BackupTarget
+	}
+	return cfg.BackupDir
+}
+
+// SubSink returns a view of s with every key prefixed by prefix (e.g. "vm1/2026-01-27_14-30").
+func SubSink(s Sink, prefix string) Sink {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return s
+	}
+	if ps, ok := s.(*prefixSink); ok {
+		return &prefixSink{base: ps.base, prefix: ps.prefix + "/" + prefix}
+	}
+	return &prefixSink{base: s, prefix: prefix}
+}
+
+type prefixSink struct {
+	base   Sink
+	prefix string
+}
+
+func (s *prefixSink) key(k string) string {
+	return s.prefix + "/" + k
+}
+
+func (s *prefixSink) Create(ctx context.Context, key string) (SinkWriter, error) {
+	return s.base.Create(ctx, s.key(key))
+}
+
+func (s *prefixSink) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.base.Open(ctx, s.key(key))
+}
+
+func (s *prefixSink) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objs, err := s.base.List(ctx, s.key(prefix))
+	if err != nil {
+		return nil, err
+	}
+	for i := range objs {
+		objs[i].Key = strings.TrimPrefix(objs[i].Key, s.prefix+"/")
+	}
+	return objs, nil
+}
+
+func (s *prefixSink) Delete(ctx context.Context, key string) error {
+	return s.base.Delete(ctx, s.key(key))
+}
+
+func (s *prefixSink) String() string {
+	return strings.TrimSuffix(s.base.String(), "/") + "/" + s.prefix
+}
+
+// writeObject stores data under key.
+func writeObject(ctx context.Context, s Sink, key string, data []byte) error {
+	w, err := s.Create(ctx, key)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Close()
+}
+
+// readObject returns the contents of key.
+func readObject(ctx context.Context, s Sink, key string) ([]byte, error) {
+	rc, err := s.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// listDirs returns the distinct first path elements of the keys under prefix
+// (the "subdirectories" of prefix), sorted.
+func listDirs(ctx context.Context, s Sink, prefix string) ([]string, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	objs, err := s.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	seen := map[string]bool{}
+	for _, o := range objs {
+		rest := strings.TrimPrefix(o.Key, prefix)
+		i := strings.Index(rest, "/")
+		if i <= 0 {
+			continue
+		}
+		d := rest[:i]
+		if !seen[d] {
+			seen[d] = true
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs, nil
+}
+
+// listVMNames returns the VM directories at the top of a backup target, skipping
+// reserved names that start with "_" (such as the chunk store), followed by the
+// unattached volume directories as _volumes/<dir>.
+func listVMNames(ctx context.Context, s Sink) ([]string, error) {
+	dirs, err := listDirs(ctx, s, "")
+	if err != nil {
+		return nil, err
+	}
+	var vms []string
+	hasVolumes := false
+	for _, d := range dirs {
+		switch {
+		case d == DetachedVolumesDir:
+			hasVolumes = true
+		case !strings.HasPrefix(d, "_"):
+			vms = append(vms, d)
+		}
+	}
+	if hasVolumes {
+		vols, err := listDirs(ctx, s, DetachedVolumesDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vols {
+			vms = append(vms, path.Join(DetachedVolumesDir, v))
+		}
+	}
+	return vms, nil
+}
+
+// joinTarget appends name to a file path or URL target, e.g. ("s3://b/backups", "east") ->
+// "s3://b/backups/east".
+func joinTarget(target, name string) string {
+	if strings.Contains(target, "://") {
+		return strings.TrimRight(target, "/") + "/" + name
+	}
+	return filepath.Join(target, name)
+}
+
+// splitTarget splits a file path or URL into its parent location and final element,
+// e.g. "s3://b/vm1/ts/vol.qcow2" -> ("s3://b/vm1/ts", "vol.qcow2").
+func splitTarget(target string) (dir, name string) {
+	if i := strings.Index(target, "://"); i >= 0 {
+		scheme, rest := target[:i+3], target[i+3:]
+		return scheme + path.Dir(rest), path.Base(rest)
+	}
+	i := strings.LastIndexAny(target, `/\`)
+	switch {
+	case i < 0:
+		return ".", target
+	case i == 0:
+		return "/", target[1:]
+	}
+	return target[:i], target[i+1:]
+}
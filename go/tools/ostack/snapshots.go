@@ -0,0 +1,178 @@
+package ostack
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/v2/pagination"
+)
+
+// SnapshotMetaRunID is the snapshot metadata key naming the backup run (VM/YYYY-MM-DD_HH-MM) that kept
+// the snapshot. Only snapshots carrying it are pruned by snapshot_retention.
+const SnapshotMetaRunID = "protect-ostack:run-id"
+
+// keptSnapshotOpts returns the name and metadata of a snapshot kept under snapshot_retention.
+func keptSnapshotOpts(volID, runID, timestamp string) (string, map[string]string) {
+	return "protect-ostack-" + volID + "-" + timestamp, map[string]string{SnapshotMetaRunID: runID}
+}
+
+// backupSnapshotOpts returns the options for the snapshot a backup of volID starts from. With keep,
+// it is named and tagged to be kept under snapshot_retention.
+func backupSnapshotOpts(volID, runID string, keep bool) snapshots.CreateOpts {
+	timestamp := time.Now().Format("2006-01-02_1504")
+	opts := snapshots.CreateOpts{
+		VolumeID: volID,
+		Name:     "snap-" + volID + "-" + timestamp,
+		Force:    true,
+	}
+	if keep {
+		opts.Name, opts.Metadata = keptSnapshotOpts(volID, runID, timestamp)
+	}
+	return opts
+}
+
+// takenSnapshot is a volume snapshot taken before the volume's backup starts: a group snapshot
+// member, or one of the snapshots taken while the guest was frozen.
+type takenSnapshot struct {
+	ID string
+	// GroupSnapshotID is set for a group snapshot member, which is deleted with its group snapshot.
+	// Other taken snapshots belong to the backup, like the ones it creates itself.
+	GroupSnapshotID string
+	// used is set once a backup has taken over the snapshot.
+	used bool
+}
+
+// owned reports whether the backup deletes (or keeps) the snapshot.
+func (s *takenSnapshot) owned() bool {
+	return s == nil || s.GroupSnapshotID == ""
+}
+
+// snapshotVolumes snapshots volIDs at once (between f.Freeze and f.Thaw) and waits until all are
+// available. keep tags them for snapshot_retention. On error, the snapshots are deleted.
+func snapshotVolumes(ctx context.Context, blockClient *gophercloud.ServiceClient, cfg *Config, f *guestFreezer, volIDs []string, runID string, keep bool) (map[string]*takenSnapshot, error) {
+	taken := map[string]*takenSnapshot{}
+	var err error
+	f.Freeze(ctx)
+	for _, id := range volIDs {
+		var snap *snapshots.Snapshot
+		snap, err = snapshots.Create(ctx, blockClient, backupSnapshotOpts(id, runID, keep)).Extract()
+		if err != nil {
+			err = fmt.Errorf("snapshot volume %s: %w", id, err)
+			break
+		}
+		taken[id] = &takenSnapshot{ID: snap.ID}
+		log.Printf("Created snapshot %s of volume %s", snap.ID, id)
+	}
+	if err == nil {
+		waitCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.StatusTimeoutSec)*time.Second)
+		defer cancel()
+		for id, s := range taken {
+			if err = snapshots.WaitForStatus(waitCtx, blockClient, s.ID, "available"); err != nil {
+				err = fmt.Errorf("snapshot %s of volume %s: %w", s.ID, id, err)
+				break
+			}
+		}
+	}
+	f.Thaw(ctx)
+	if err != nil {
+		deleteUnusedSnapshots(ctx, blockClient, taken)
+		return nil, err
+	}
+	return taken, nil
+}
+
+// deleteUnusedSnapshots deletes the owned snapshots in taken that no backup took over, e.g. because
+// the run was canceled before their volume's turn. Failures are logged.
+func deleteUnusedSnapshots(ctx context.Context, blockClient *gophercloud.ServiceClient, taken map[string]*takenSnapshot) {
+	for _, s := range taken {
+		if s.used || !s.owned() {
+			continue
+		}
+		if err := snapshots.Delete(ctx, blockClient, s.ID).ExtractErr(); err != nil {
+			log.Printf("Warning: Failed to delete snapshot %s: %v", s.ID, err)
+		} else {
+			log.Printf("Cleaned up snapshot: %s", s.ID)
+		}
+	}
+}
+
+// pruneVolumeSnapshots deletes the kept snapshots of volID beyond the newest keep.
+// Failures are logged; a snapshot that still has dependent volumes cannot be deleted.
+func pruneVolumeSnapshots(ctx context.Context, blockClient *gophercloud.ServiceClient, volID string, keep int) {
+	var kept []snapshots.Snapshot
+	err := snapshots.ListDetail(blockClient, snapshots.ListOpts{VolumeID: volID}).EachPage(ctx,
+		func(_ context.Context, page pagination.Page) (bool, error) {
+			list, err := snapshots.ExtractSnapshots(page)
+			if err != nil {
+				return false, err
+			}
+			for _, s := range list {
+				if _, ok := s.Metadata[SnapshotMetaRunID]; ok && s.VolumeID == volID {
+					kept = append(kept, s)
+				}
+			}
+			return true, nil
+		})
+	if err != nil {
+		log.Printf("Warning: Failed to list snapshots of volume %s: %v", volID, err)
+		return
+	}
+	if len(kept) <= keep {
+		return
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].CreatedAt.After(kept[j].CreatedAt) })
+	for _, s := range kept[keep:] {
+		if err := snapshots.Delete(ctx, blockClient, s.ID).ExtractErr(); err != nil {
+			log.Printf("Warning: Failed to delete snapshot %s: %v", s.ID, err)
+			continue
+		}
+		log.Printf("Pruned snapshot %s of volume %s (run %s)", s.ID, volID, s.Metadata[SnapshotMetaRunID])
+	}
+}
+
+// keptSnapshotID returns the snapshot kept in the cloud for the original volume volID, or "".
+func keptSnapshotID(manifest *Manifest, volID string) string {
+	if manifest == nil {
+		return ""
+	}
+	if a := manifest.VolumeArtifact(volID); a != nil && a.Volume.SnapshotKept {
+		return a.Volume.SnapshotID
+	}
+	return ""
+}
+
+// volumeFromSnapshot creates a volume named name from a kept snapshot and waits for it to become
+// available. The volume is at least minSizeGB. Returns the new volume ID, also with the error if the
+// volume was created but did not become available.
+func volumeFromSnapshot(ctx context.Context, blockClient *gophercloud.ServiceClient, cfg *Config, snapID, name string, minSizeGB int) (string, error) {
+	snap, err := snapshots.Get(ctx, blockClient, snapID).Extract()
+	if err != nil {
+		return "", fmt.Errorf("snapshot %s: %w", snapID, err)
+	}
+	if snap.Status != "available" {
+		return "", fmt.Errorf("snapshot %s is %s", snapID, snap.Status)
+	}
+	sizeGB := max(snap.Size, minSizeGB)
+	log.Printf("Creating volume %s (%dGB) from snapshot %s", name, sizeGB, snapID)
+	vol, err := volumes.Create(ctx, blockClient, volumes.CreateOpts{
+		Name:       name,
+		Size:       sizeGB,
+		SnapshotID: snapID,
+	}, nil).Extract()
+	if err != nil {
+		return "", err
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.StatusTimeoutSec)*time.Second)
+	defer cancel()
+	if err := volumes.WaitForStatus(waitCtx, blockClient, vol.ID, "available"); err != nil {
+		return vol.ID, fmt.Errorf("volume %s: %w", vol.ID, err)
+	}
+	log.Printf("Volume %s is available", vol.ID)
+	return vol.ID, nil
+}
@@ -0,0 +1,366 @@
+package ostack
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/gophercloud/v2/openstack/objectstorage/v1/containers"
+	"github.com/gophercloud/gophercloud/v2/openstack/objectstorage/v1/objects"
+	"github.com/gophercloud/gophercloud/v2/pagination"
+)
+
+// SwiftConfig configures swift:// backup targets.
+type SwiftConfig struct {
+	// Region of the object-store endpoint; empty = region. Set it to keep copies in another region.
+	Region string `yaml:"region"`
+	// SegmentSizeMB is the Static Large Object segment size. Swift's default limit of 1000
+	// segments per manifest caps objects at 1000 × this size.
+	SegmentSizeMB int `yaml:"segment_size_mb"`
+	// SegmentContainer holds the segments; empty = "<container>_segments".
+	SegmentContainer string `yaml:"segment_container"`
+	// KeystoneURL, Project, User, Password, and Domain authenticate against a different
+	// cloud for off-site copies; empty KeystoneURL = the main credentials.
+	KeystoneURL string `yaml:"keystone_url"`
+	Project     string `yaml:"project"`
+	User        string `yaml:"user"`
+	Password    string `yaml:"password"`
+	Domain      string `yaml:"domain"`
+}
+
+const (
+	defaultSwiftSegmentSizeMB = 1024
+	// swiftInlineLimit is the largest object uploaded with a single PUT; larger ones become SLOs.
+	swiftInlineLimit = 8 << 20
+)
+
+// SwiftSink stores artifacts in a Swift container under a key prefix.
+// Objects larger than swiftInlineLimit are uploaded as Static Large Objects.
+type SwiftSink struct {
+	client       *gophercloud.ServiceClient
+	container    string
+	segContainer string
+	prefix       string
+	segLen       int64
+
+	ensureOnce sync.Once
+	ensureErr  error
+}
+
+// NewSwiftSink authenticates with Keystone (cfg, or cfg.Swift's separate cloud) and
+// returns a sink for the container and prefix of a swift://CONTAINER/PREFIX target.
+func NewSwiftSink(ctx context.Context, cfg *Config, container, prefix string) (*SwiftSink, error) {
+	authCfg := cfg
+	if cfg.Swift.KeystoneURL != "" {
+		c := *cfg
+		c.AuthConfig = AuthConfig{
+			KeystoneURL: cfg.Swift.KeystoneURL,
+			Project:     cfg.Swift.Project,
+			User:        cfg.Swift.User,
+			Password:    cfg.Swift.Password,
+			Domain:      cfg.Swift.Domain,
+		}
+		if c.Domain == "" {
+			c.Domain = cfg.Domain
+		}
+		authCfg = &c
+	}
+	provider, err := NewProvider(ctx, authCfg)
+	if err != nil {
+		return nil, fmt.Errorf("swift auth: %w", err)
+	}
+	region := cfg.Swift.Region
+	if region == "" {
+		region = authCfg.Region
+	}
+	client, err := openstack.NewObjectStorageV1(provider, endpointOpts(authCfg, region))
+	if err != nil {
+		return nil, fmt.Errorf("object storage client: %w", err)
+	}
+	segMB := cfg.Swift.SegmentSizeMB
+	if segMB <= 0 {
+		segMB = defaultSwiftSegmentSizeMB
+	}
+	segContainer := cfg.Swift.SegmentContainer
+	if segContainer == "" {
+		segContainer = container + "_segments"
+	}
+	return &SwiftSink{
+		client:       client,
+		container:    container,
+		segContainer: segContainer,
+		prefix:       strings.Trim(prefix, "/"),
+		segLen:       int64(segMB) << 20,
+	}, nil
+}
+
+func (s *SwiftSink) key(k string) string {
+	if s.prefix == "" {
+		return k
+	}
+	return s.prefix + "/" + k
+}
+
+// ensureContainers creates the container and segment container on first write (PUT is idempotent).
+func (s *SwiftSink) ensureContainers(ctx context.Context) error {
+	s.ensureOnce.Do(func() {
+		for _, c := range []string{s.container, s.segContainer} {
+			if err := containers.Create(ctx, s.client, c, nil).Err; err != nil {
+				s.ensureErr = fmt.Errorf("create container %s: %w", c, err)
+				return
+			}
+		}
+	})
+	return s.ensureErr
+}
+
+// Create streams key to Swift. Small objects are sent with one PUT on Close; larger ones are
+// streamed segment by segment and committed as a Static Large Object manifest on Close.
+func (s *SwiftSink) Create(ctx context.Context, key string) (SinkWriter, error) {
+	if err := s.ensureContainers(ctx); err != nil {
+		return nil, err
+	}
+	name := s.key(key)
+	return &swiftWriter{
+		ctx:       ctx,
+		s:         s,
+		key:       name,
+		segPrefix: fmt.Sprintf("%s/slo/%d", name, time.Now().UnixNano()),
+	}, nil
+}
+
+func (s *SwiftSink) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	res := objects.Download(ctx, s.client, s.container, s.key(key), nil)
+	if res.Err != nil {
+		if gophercloud.ResponseCodeIs(res.Err, http.StatusNotFound) {
+			return nil, fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		return nil, res.Err
+	}
+	return res.Body, nil
+}
+
+func (s *SwiftSink) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objs []ObjectInfo
+	err := objects.List(s.client, s.container, objects.ListOpts{Prefix: s.key(prefix)}).EachPage(ctx,
+		func(_ context.Context, page pagination.Page) (bool, error) {
+			infos, err := objects.ExtractInfo(page)
+			if err != nil {
+				return false, err
+			}
+			for _, o := range infos {
+				key := o.Name
+				if s.prefix != "" {
+					key = strings.TrimPrefix(key, s.prefix+"/")
+				}
+				objs = append(objs, ObjectInfo{Key: key, Size: o.Bytes})
+			}
+			return true, nil
+		})
+	if err != nil {
+		if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return objs, nil
+}
+
+// Delete removes key; for a Static Large Object its segments are removed too.
+func (s *SwiftSink) Delete(ctx context.Context, key string) error {
+	err := objects.Delete(ctx, s.client, s.container, s.key(key), objects.DeleteOpts{MultipartManifest: "delete"}).Err
+	if err != nil && !gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (s *SwiftSink) String() string {
+	if s.prefix == "" {
+		return "swift://" + s.container
+	}
+	return "swift://" + s.container + "/" + s.prefix
+}
+
+// sloSegment is one entry of a Static Large Object manifest.
+type sloSegment struct {
+	Path      string `json:"path"`
+	Etag      string `json:"etag"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// swiftSegment is a segment being streamed to Swift through a pipe.
+type swiftSegment struct {
+	name string
+	pw   *io.PipeWriter
+	md5  hash.Hash
+	n    int64
+	errc chan error
+}
+
+type swiftWriter struct {
+	ctx       context.Context
+	s         *SwiftSink
+	key       string
+	segPrefix string
+	inline    bytes.Buffer
+	seg       *swiftSegment
+	segs      []sloSegment
+	done      bool
+}
+
+func (w *swiftWriter) Write(p []byte) (int, error) {
+	if w.seg == nil && len(w.segs) == 0 && w.inline.Len()+len(p) <= swiftInlineLimit {
+		return w.inline.Write(p)
+	}
+	if w.inline.Len() > 0 {
+		pending := w.inline.Bytes()
+		w.inline = bytes.Buffer{}
+		if _, err := w.writeSegments(pending); err != nil {
+			return 0, err
+		}
+	}
+	return w.writeSegments(p)
+}
+
+// writeSegments streams p into the current segment, rolling over to a new one every segLen bytes.
+func (w *swiftWriter) writeSegments(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if w.seg == nil {
+			w.startSegment()
+		}
+		chunk := p
+		if room := w.s.segLen - w.seg.n; int64(len(chunk)) > room {
+			chunk = chunk[:room]
+		}
+		c, err := w.seg.pw.Write(chunk)
+		w.seg.md5.Write(chunk[:c])
+		w.seg.n += int64(c)
+		n += c
+		if err != nil {
+			return n, fmt.Errorf("upload segment %s: %w", w.seg.name, err)
+		}
+		p = p[c:]
+		if w.seg.n == w.s.segLen {
+			if err := w.finishSegment(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *swiftWriter) startSegment() {
+	// A streamed segment cannot be resent after a 401, so renew a token about to expire first.
+	ensureToken(w.ctx, w.s.client)
+	pr, pw := io.Pipe()
+	seg := &swiftSegment{
+		name: fmt.Sprintf("%s/%08d", w.segPrefix, len(w.segs)),
+		pw:   pw,
+		md5:  md5.New(),
+		errc: make(chan error, 1),
+	}
+	go func() {
+		// NoETag keeps gophercloud from reading the whole segment into memory to hash it;
+		// the body is sent with chunked transfer encoding.
+		err := objects.Create(w.ctx, w.s.client, w.s.segContainer, seg.name, objects.CreateOpts{
+			Content: pr,
+			NoETag:  true,
+		}).Err
+		pr.CloseWithError(err)
+		seg.errc <- err
+	}()
+	w.seg = seg
+}
+
+func (w *swiftWriter) finishSegment() error {
+	seg := w.seg
+	w.seg = nil
+	seg.pw.Close()
+	if err := <-seg.errc; err != nil {
+		return fmt.Errorf("upload segment %s: %w", seg.name, err)
+	}
+	w.segs = append(w.segs, sloSegment{
+		Path:      "/" + w.s.segContainer + "/" + seg.name,
+		Etag:      hex.EncodeToString(seg.md5.Sum(nil)),
+		SizeBytes: seg.n,
+	})
+	return nil
+}
+
+func (w *swiftWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.seg == nil && len(w.segs) == 0 {
+		err := objects.Create(w.ctx, w.s.client, w.s.container, w.key, objects.CreateOpts{
+			Content: bytes.NewReader(w.inline.Bytes()),
+		}).Err
+		if err != nil {
+			return fmt.Errorf("put %s: %w", w.key, err)
+		}
+		return nil
+	}
+	if w.seg != nil {
+		if err := w.finishSegment(); err != nil {
+			w.deleteSegments()
+			return err
+		}
+	}
+	manifest, err := json.Marshal(w.segs)
+	if err != nil {
+		return err
+	}
+	// Swift validates the manifest against the segments' ETags and sizes.
+	err = objects.Create(w.ctx, w.s.client, w.s.container, w.key, objects.CreateOpts{
+		Content:           bytes.NewReader(manifest),
+		NoETag:            true,
+		MultipartManifest: "put",
+	}).Err
+	if err != nil {
+		w.deleteSegments()
+		return fmt.Errorf("put SLO manifest %s (%d segments): %w", w.key, len(w.segs), err)
+	}
+	return nil
+}
+
+// Abort stops the current segment upload and removes the segments uploaded so far.
+func (w *swiftWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.seg != nil {
+		w.seg.pw.CloseWithError(errors.New("upload aborted"))
+		<-w.seg.errc
+		w.seg = nil
+	}
+	w.deleteSegments()
+	return nil
+}
+
+func (w *swiftWriter) deleteSegments() {
+	for _, seg := range w.segs {
+		name := strings.TrimPrefix(seg.Path, "/"+w.s.segContainer+"/")
+		if err := objects.Delete(context.Background(), w.s.client, w.s.segContainer, name, nil).Err; err != nil &&
+			!gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			log.Printf("Warning: Failed to delete segment %s: %v", seg.Path, err)
+		}
+	}
+	w.segs = nil
+}
@@ -0,0 +1,209 @@
+package ostack
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/v2"
+)
+
+// fakeSwift is an in-memory Swift endpoint with the container, object, and Static Large Object
+// calls the sink uses. Objects are keyed by "container/name".
+type fakeSwift struct {
+	mu         sync.Mutex
+	containers map[string]bool
+	objects    map[string][]byte
+	// manifests holds the segment paths of each SLO.
+	manifests map[string][]string
+	// failManifest rejects SLO manifest uploads.
+	failManifest bool
+}
+
+func newFakeSwift(t *testing.T) (*fakeSwift, *SwiftSink) {
+	f := &fakeSwift{containers: map[string]bool{}, objects: map[string][]byte{}, manifests: map[string][]string{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	client := &gophercloud.ServiceClient{ProviderClient: &gophercloud.ProviderClient{}, Endpoint: srv.URL + "/"}
+	s := &SwiftSink{client: client, container: "backups", segContainer: "backups_segments", prefix: "prod", segLen: 3 << 20}
+	return f, s
+}
+
+func (f *fakeSwift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	container, name, _ := strings.Cut(path, "/")
+	q := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+	switch {
+	case r.Method == http.MethodPut && name == "":
+		f.containers[container] = true
+		w.WriteHeader(http.StatusCreated)
+	case !f.containers[container]:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodGet && name == "":
+		type info struct {
+			Name  string `json:"name"`
+			Bytes int64  `json:"bytes"`
+		}
+		list := []info{}
+		for key, data := range f.objects {
+			c, n, _ := strings.Cut(key, "/")
+			if c == container && strings.HasPrefix(n, q.Get("prefix")) && n > q.Get("marker") {
+				list = append(list, info{Name: n, Bytes: int64(len(data))})
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPut && q.Get("multipart-manifest") == "put":
+		var segs []sloSegment
+		if err := json.Unmarshal(body, &segs); err != nil || f.failManifest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		var paths []string
+		for _, seg := range segs {
+			part, ok := f.objects[strings.TrimPrefix(seg.Path, "/")]
+			sum := md5.Sum(part)
+			if !ok || hex.EncodeToString(sum[:]) != seg.Etag || int64(len(part)) != seg.SizeBytes {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data = append(data, part...)
+			paths = append(paths, strings.TrimPrefix(seg.Path, "/"))
+		}
+		f.objects[path] = data
+		f.manifests[path] = paths
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut:
+		f.objects[path] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case r.Method == http.MethodDelete:
+		if _, ok := f.objects[path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if q.Get("multipart-manifest") == "delete" {
+			for _, seg := range f.manifests[path] {
+				delete(f.objects, seg)
+			}
+		}
+		delete(f.objects, path)
+		delete(f.manifests, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// segments returns the number of objects in the segment container.
+func (f *fakeSwift) segments() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for key := range f.objects {
+		if strings.HasPrefix(key, "backups_segments/") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSwiftSinkRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		size     int
+		wantSegs int
+	}{
+		{"inline", swiftInlineLimit, 0},
+		{"over the inline limit", swiftInlineLimit + 1, 3},
+		{"segment boundary", 4 * 3 << 20, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, s := newFakeSwift(t)
+			data := randomData(int64(tt.size), tt.size)
+			if err := writeObject(ctx, s, "vm1/vol.qcow2", data); err != nil {
+				t.Fatal(err)
+			}
+			if got := len(f.manifests["backups/prod/vm1/vol.qcow2"]); got != tt.wantSegs {
+				t.Errorf("%d segments in the manifest, want %d", got, tt.wantSegs)
+			}
+			if got := f.segments(); got != tt.wantSegs {
+				t.Errorf("%d segment objects, want %d", got, tt.wantSegs)
+			}
+			got, err := readObject(ctx, s, "vm1/vol.qcow2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("read %d bytes, want %d", len(got), len(data))
+			}
+			objs, err := s.List(ctx, "vm1/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(objs) != 1 || objs[0].Key != "vm1/vol.qcow2" || objs[0].Size != int64(tt.size) {
+				t.Errorf("List = %+v, want vm1/vol.qcow2 of %d bytes", objs, tt.size)
+			}
+			if err := s.Delete(ctx, "vm1/vol.qcow2"); err != nil {
+				t.Fatal(err)
+			}
+			if n := f.segments(); n != 0 {
+				t.Errorf("%d segments left after Delete", n)
+			}
+		})
+	}
+}
+
+func TestSwiftWriterCleansUpSegments(t *testing.T) {
+	ctx := context.Background()
+	data := randomData(1, 7<<20+swiftInlineLimit)
+
+	f, s := newFakeSwift(t)
+	f.failManifest = true
+	if err := writeObject(ctx, s, "obj", data); err == nil {
+		t.Fatal("write succeeded, want manifest error")
+	}
+	if n := f.segments(); n != 0 {
+		t.Errorf("failed manifest: %d segments left", n)
+	}
+
+	f, s = newFakeSwift(t)
+	w, err := s.Create(ctx, "obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.segments(); n != 0 {
+		t.Errorf("Abort: %d segments left", n)
+	}
+	if _, err := readObject(ctx, s, "obj"); err == nil {
+		t.Error("aborted object exists")
+	}
+}
@@ -0,0 +1,143 @@
+package ostack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TargetConfig is one entry of targets: a cloud and region backed up in the same invocation as
+// the others. Besides name and cloud it may set any top-level config key (keystone_url, region,
+// credentials, filters, ...), which overrides the top-level value for this target only.
+type TargetConfig struct {
+	// Name names the target's directory under the backup target and its summary line.
+	Name string `yaml:"name"`
+	// Cloud is a clouds.yaml cloud applied before the target's own keys.
+	Cloud string `yaml:"cloud"`
+
+	node yaml.Node
+}
+
+// UnmarshalYAML keeps the entry's node so its keys can be applied over the top-level config.
+func (t *TargetConfig) UnmarshalYAML(n *yaml.Node) error {
+	type plain TargetConfig
+	if err := n.Decode((*plain)(t)); err != nil {
+		return err
+	}
+	t.node = *n
+	return nil
+}
+
+// hasSecrets reports whether the target's own keys hold a password, secret, or token.
+func (t TargetConfig) hasSecrets() bool {
+	var c Config
+	if err := t.node.Decode(&c); err != nil {
+		return false
+	}
+	return c.hasSecrets()
+}
+
+// TargetName returns the name of the target cfg was built for, or "" outside of targets.
+func (cfg *Config) TargetName() string {
+	return cfg.targetName
+}
+
+// TargetConfigs returns the config of each of cfg.Targets: cfg (config file, clouds.yaml,
+// environment, and flags), then the target's cloud, then the target's own keys. Each target is
+// stored under <backup target>/<name>.
+func TargetConfigs(cfg *Config) ([]*Config, error) {
+	seen := map[string]bool{}
+	var out []*Config
+	for i, t := range cfg.Targets {
+		switch {
+		case t.Name == "":
+			return nil, fmt.Errorf("targets[%d]: missing name", i)
+		case strings.ContainsAny(t.Name, `/\`) || strings.HasPrefix(t.Name, ".") || strings.HasPrefix(t.Name, "_"):
+			return nil, fmt.Errorf("target %q: name must be a plain directory name", t.Name)
+		case seen[t.Name]:
+			return nil, fmt.Errorf("target %q: duplicate name", t.Name)
+		}
+		seen[t.Name] = true
+		c := *cfg
+		c.Targets = nil
+		// Decoding into a shared map would change cfg and the other targets.
+		c.RetentionOverrides = maps.Clone(cfg.RetentionOverrides)
+		if t.Cloud != "" {
+			if err := ApplyCloud(&c, t.Cloud); err != nil {
+				return nil, fmt.Errorf("target %s: %w", t.Name, err)
+			}
+		}
+		if err := t.node.Decode(&c); err != nil {
+			return nil, fmt.Errorf("target %s: %w", t.Name, err)
+		}
+		c.Targets = nil
+		c.targetName = t.Name
+		c.BackupDir = filepath.Join(c.BackupDir, t.Name)
+		if c.BackupTarget != "" {
+			c.BackupTarget = joinTarget(c.BackupTarget, t.Name)
+		}
+		out = append(out, &c)
+	}
+	return out, nil
+}
+
+// targetResult is the outcome of one target of RunTargets.
+type targetResult struct {
+	name     string
+	dest     string
+	duration time.Duration
+	err      error
+}
+
+// RunTargets backs up each target config (from TargetConfigs) in turn, with its own
+// authentication, and logs a per-target summary. A failed target does not stop the others;
+// the returned error joins the failures.
+func RunTargets(ctx context.Context, targets []*Config) error {
+	results := make([]targetResult, len(targets))
+	for i, tcfg := range targets {
+		res := &results[i]
+		res.name, res.dest = tcfg.targetName, tcfg.Target()
+		start := time.Now()
+		log.Printf("==== Target: %s (Keystone: %s, Region: %s) ====", tcfg.targetName, tcfg.KeystoneURL, tcfg.Region)
+		res.err = runTarget(ctx, tcfg)
+		res.duration = time.Since(start).Round(time.Second)
+		if res.err != nil {
+			log.Printf("Warning: Target %s failed: %v", tcfg.targetName, res.err)
+		}
+	}
+
+	var errs []error
+	log.Println("==== Targets ====")
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("target %s: %w", r.name, r.err))
+			log.Printf("%s: FAILED after %s: %v", r.name, r.duration, r.err)
+			continue
+		}
+		log.Printf("%s: completed in %s -> %s", r.name, r.duration, r.dest)
+	}
+	log.Printf("Targets: %d completed, %d failed", len(results)-len(errs), len(errs))
+	return errors.Join(errs...)
+}
+
+// runTarget authenticates with the target's cloud and runs its backup.
+func runTarget(ctx context.Context, tcfg *Config) error {
+	if tcfg.BackupTarget == "" {
+		if err := os.MkdirAll(tcfg.BackupDir, 0755); err != nil {
+			return fmt.Errorf("create backup dir: %w", err)
+		}
+	}
+	provider, err := NewProvider(ctx, tcfg)
+	if err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	return Run(ctx, provider, tcfg)
+}
@@ -0,0 +1,91 @@
+package ostack
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig holds the TLS settings of every HTTPS connection the tool makes: Keystone, the
+// OpenStack service endpoints (including image downloads and Swift), and S3.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of CA certificates trusted in addition to the system roots.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are a PEM client certificate and its key, for endpoints that require one.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// InsecureSkipVerify disables server certificate verification. For lab clouds only.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+var insecureWarning sync.Once
+
+// isZero reports whether t changes nothing from the default TLS settings.
+func (t TLSConfig) isZero() bool {
+	return t == TLSConfig{}
+}
+
+// clientConfig builds the crypto/tls configuration for t.
+func (t TLSConfig) clientConfig() (*tls.Config, error) {
+	tc := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.InsecureSkipVerify {
+		insecureWarning.Do(func() {
+			log.Println("Warning: TLS certificate verification is disabled (tls.insecure_skip_verify)")
+		})
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.ca_file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls.ca_file %s: no PEM certificates found", t.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	switch {
+	case t.CertFile != "" && t.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	case t.CertFile != "" || t.KeyFile != "":
+		return nil, fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	return tc, nil
+}
+
+const (
+	// tlsHandshakeTimeout and responseHeaderTimeout bound how long a request waits for an endpoint
+	// that accepts the connection but never answers. They do not limit reading the body, so long
+	// image downloads and uploads are not cut off.
+	tlsHandshakeTimeout   = 10 * time.Second
+	responseHeaderTimeout = 60 * time.Second
+)
+
+// Transport returns a copy of http.DefaultTransport using t, with handshake and response header
+// timeouts.
+func (t TLSConfig) Transport() (http.RoundTripper, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSHandshakeTimeout = tlsHandshakeTimeout
+	tr.ResponseHeaderTimeout = responseHeaderTimeout
+	if t.isZero() {
+		return tr, nil
+	}
+	tc, err := t.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	tr.TLSClientConfig = tc
+	return tr, nil
+}
@@ -0,0 +1,91 @@
+package ostack
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTLSConfigTransport(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Header().Set("X-Client-Cert", "yes")
+		}
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	ca := write("ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	notPEM := write("not.pem", []byte("not a certificate"))
+	// httptest's certificate and key double as the client certificate.
+	cert := write("cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+	der, err := x509.MarshalPKCS8PrivateKey(srv.TLS.Certificates[0].PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := write("key.pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	tests := []struct {
+		name       string
+		tls        TLSConfig
+		wantErr    string
+		wantGetErr bool
+		wantCert   bool
+	}{
+		{name: "system roots reject the test CA", wantGetErr: true},
+		{name: "ca_file", tls: TLSConfig{CAFile: ca}},
+		{name: "insecure_skip_verify", tls: TLSConfig{InsecureSkipVerify: true}},
+		{name: "client certificate", tls: TLSConfig{CAFile: ca, CertFile: cert, KeyFile: key}, wantCert: true},
+		{name: "missing ca_file", tls: TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}, wantErr: "tls.ca_file"},
+		{name: "ca_file without certificates", tls: TLSConfig{CAFile: notPEM}, wantErr: "no PEM certificates"},
+		{name: "cert_file without key_file", tls: TLSConfig{CertFile: cert}, wantErr: "must be set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := tt.tls.Transport()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ht := tr.(*http.Transport)
+			if ht.TLSHandshakeTimeout != tlsHandshakeTimeout || ht.ResponseHeaderTimeout != responseHeaderTimeout {
+				t.Errorf("timeouts = %v, %v, want %v, %v", ht.TLSHandshakeTimeout, ht.ResponseHeaderTimeout, tlsHandshakeTimeout, responseHeaderTimeout)
+			}
+			resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+			if tt.wantGetErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatal("request succeeded, want certificate error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := resp.Header.Get("X-Client-Cert") != ""; got != tt.wantCert {
+				t.Errorf("client certificate sent = %v, want %v", got, tt.wantCert)
+			}
+		})
+	}
+}
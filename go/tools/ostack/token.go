@@ -0,0 +1,70 @@
+package ostack
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/identity/v3/tokens"
+)
+
+// tokenRenewMargin is the validity a token must have left before a long operation (a status wait,
+// an image or segment transfer); a token closer to expiry is renewed first.
+const tokenRenewMargin = 10 * time.Minute
+
+// tokenExpiry returns when provider's current token expires, or the zero time if unknown.
+func tokenExpiry(provider *gophercloud.ProviderClient) time.Time {
+	var tok *tokens.Token
+	var err error
+	switch r := provider.GetAuthResult().(type) {
+	case tokens.CreateResult:
+		tok, err = r.ExtractToken()
+	case tokens.GetResult:
+		tok, err = r.ExtractToken()
+	default:
+		return time.Time{}
+	}
+	if err != nil {
+		return time.Time{}
+	}
+	return tok.ExpiresAt
+}
+
+// logReauth wraps the ReauthFunc that Authenticate sets up (AllowReauth) to log each
+// re-authentication. Gophercloud calls it when a request gets a 401.
+func logReauth(provider *gophercloud.ProviderClient) {
+	reauth := provider.ReauthFunc
+	if reauth == nil {
+		return
+	}
+	provider.ReauthFunc = func(ctx context.Context) error {
+		log.Println("Re-authenticating with Keystone")
+		if err := reauth(ctx); err != nil {
+			log.Printf("Warning: Failed to re-authenticate with Keystone: %v", err)
+			return err
+		}
+		if exp := tokenExpiry(provider); !exp.IsZero() {
+			log.Printf("Re-authenticated with Keystone; new token expires %s", exp.Format(time.RFC3339))
+		} else {
+			log.Println("Re-authenticated with Keystone")
+		}
+		return nil
+	}
+}
+
+// ensureToken renews client's token if it expires within tokenRenewMargin. Call it before long
+// operations: requests that get a 401 are retried after re-authentication, but a streamed body
+// cannot be sent twice. Does nothing for clients that cannot re-authenticate (auth_type: token);
+// a failure is only logged, as the next request re-authenticates again.
+func ensureToken(ctx context.Context, client *gophercloud.ServiceClient) {
+	if client == nil || client.ProviderClient == nil || client.ReauthFunc == nil {
+		return
+	}
+	// Passing the old token lets concurrent callers share one re-authentication.
+	old := client.Token()
+	if exp := tokenExpiry(client.ProviderClient); exp.IsZero() || time.Until(exp) > tokenRenewMargin {
+		return
+	}
+	_ = client.Reauthenticate(ctx, old)
+}
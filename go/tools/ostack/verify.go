@@ -0,0 +1,304 @@
+package ostack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNoBackups is returned by Verify when no backup run matches, so that pointing it at the
+// wrong directory (e.g. the root of a multi-project or multi-target backup) does not pass.
+var ErrNoBackups = errors.New("no backups found")
+
+// VerifyOptions selects which backups Verify checks.
+type VerifyOptions struct {
+	// VM limits the check to one VM directory name; empty = all VMs.
+	VM string
+	// Since skips backup directories older than this time; zero = no limit.
+	Since time.Time
+	// Chunks is the chunk store for deduplicated images; nil = <sink>/_chunks.
+	Chunks *ChunkStore
+}
+
+// VerifyProblem is one integrity failure found by Verify.
+type VerifyProblem struct {
+	Dir     string
+	File    string
+	Problem string
+}
+
+func (p VerifyProblem) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%s: %s", p.Dir, p.Problem)
+	}
+	return fmt.Sprintf("%s/%s: %s", p.Dir, p.File, p.Problem)
+}
+
+// VerifyReport summarizes a Verify run.
+type VerifyReport struct {
+	Backups  int
+	Files    int
+	Problems []VerifyProblem
+}
+
+// OK reports whether no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) add(dir, file, format string, args ...interface{}) {
+	p := VerifyProblem{Dir: dir, File: file, Problem: fmt.Sprintf(format, args...)}
+	log.Printf("FAIL %s", p)
+	r.Problems = append(r.Problems, p)
+}
+
+// listBackupRuns returns the VM/TIMESTAMP runs in sink matching vm and since, sorted.
+func listBackupRuns(ctx context.Context, sink Sink, vm string, since time.Time) ([]string, error) {
+	vms := []string{vm}
+	if vm == "" {
+		dirs, err := listVMNames(ctx, sink)
+		if err != nil {
+			return nil, err
+		}
+		vms = dirs
+	}
+	var runs []string
+	for _, name := range vms {
+		vmRuns, err := listVMRuns(ctx, sink, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range vmRuns {
+			if !since.IsZero() && r.Time.Before(since) {
+				continue
+			}
+			runs = append(runs, r.Dir)
+		}
+	}
+	sort.Strings(runs)
+	return runs, nil
+}
+
+// Verify walks the VM/TIMESTAMP runs in sink, recomputes every artifact's SHA-256 against its
+// .sha256 sidecar (and manifest.json), validates disk image headers, and checks that each
+// image's virtual size matches the source volume size recorded in the manifest.
+func Verify(ctx context.Context, sink Sink, opts VerifyOptions) (*VerifyReport, error) {
+	runs, err := listBackupRuns(ctx, sink, opts.VM, opts.Since)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("%w under %s (for projects or targets, verify BACKUP_DIR/<project> or BACKUP_DIR/<target>)", ErrNoBackups, sink)
+	}
+	chunks := opts.Chunks
+	if chunks == nil {
+		chunks = &ChunkStore{sink: SubSink(sink, ChunkDir)}
+	}
+	report := &VerifyReport{}
+	for _, dir := range runs {
+		report.Backups++
+		verifyBackupRun(ctx, SubSink(sink, dir), chunks, report)
+	}
+	return report, nil
+}
+
+// verifyBackupRun checks one VM backup run and appends its problems to report.
+func verifyBackupRun(ctx context.Context, run Sink, chunks *ChunkStore, report *VerifyReport) {
+	dir := run.String()
+	log.Printf("Verifying %s", dir)
+	manifest, err := ReadManifest(ctx, run)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			report.add(dir, ManifestFile, "%v", err)
+		}
+		manifest = nil
+	} else if !manifest.Complete {
+		report.add(dir, "", "backup incomplete: %s", strings.Join(manifest.Errors, "; "))
+	}
+
+	objs, err := run.List(ctx, "")
+	if err != nil {
+		report.add(dir, "", "%v", err)
+		return
+	}
+	sizes := map[string]int64{}
+	for _, o := range objs {
+		sizes[o.Key] = o.Size
+	}
+	files := map[string]*Artifact{}
+	if manifest != nil {
+		for i := range manifest.Artifacts {
+			a := &manifest.Artifacts[i]
+			files[a.File] = a
+			if a.Volume != nil && a.Volume.QuiesceError != "" {
+				log.Printf("Warning: %s/%s: %s", dir, a.File, a.Volume.QuiesceError)
+			}
+		}
+	}
+	for _, o := range objs {
+		if o.Key == ManifestFile || strings.HasSuffix(o.Key, ChecksumSuffix) || strings.Contains(o.Key, "/") {
+			continue
+		}
+		if _, ok := files[o.Key]; !ok {
+			files[o.Key] = nil
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for n := range files {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		report.Files++
+		if _, ok := sizes[name]; !ok {
+			report.add(dir, name, "listed in %s but missing", ManifestFile)
+			continue
+		}
+		verifyArtifact(ctx, run, chunks, name, files[name], report)
+	}
+}
+
+// verifyArtifact checks one object; art is its manifest entry, or nil if it is not in the manifest.
+func verifyArtifact(ctx context.Context, run Sink, chunks *ChunkStore, name string, art *Artifact, report *VerifyReport) {
+	dir := run.String()
+	want, err := readChecksumSidecar(ctx, run, name)
+	if err != nil {
+		if art == nil {
+			report.add(dir, name, "no checksum sidecar and not in %s", ManifestFile)
+			return
+		}
+		report.add(dir, name, "checksum sidecar: %v", err)
+		want = art.SHA256
+	}
+
+	rc, err := run.Open(ctx, name)
+	if err != nil {
+		report.add(dir, name, "%v", err)
+		return
+	}
+	defer rc.Close()
+	hw := newHashingWriter()
+	body := io.TeeReader(rc, hw)
+	base, codec := splitCompression(name)
+	format := strings.TrimPrefix(path.Ext(base), ".")
+	image := &countingReader{r: body}
+	if codec != "" {
+		dr, err := newDecompressReader(body, codec)
+		if err != nil {
+			report.add(dir, name, "%s: %v", codec, err)
+			return
+		}
+		defer dr.Close()
+		image.r = dr
+	}
+	vsize, headerErr, err := scanImage(image, format)
+	if err != nil {
+		report.add(dir, name, "read: %v", err)
+		return
+	}
+	if codec != "" {
+		// Hash anything the decompressor left unread.
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			report.add(dir, name, "read: %v", err)
+			return
+		}
+		if art != nil && art.UncompressedBytes > 0 && art.UncompressedBytes != image.n {
+			report.add(dir, name, "uncompressed size %d differs from %s (%d)", image.n, ManifestFile, art.UncompressedBytes)
+		}
+	}
+
+	if sum := hw.Sum(); sum != want {
+		report.add(dir, name, "SHA-256 mismatch: have %s, want %s", sum, want)
+	}
+	if art != nil {
+		if art.SHA256 != want {
+			report.add(dir, name, "sidecar SHA-256 %s differs from %s (%s)", want, ManifestFile, art.SHA256)
+		}
+		if art.SizeBytes != hw.n {
+			report.add(dir, name, "size %d differs from %s (%d)", hw.n, ManifestFile, art.SizeBytes)
+		}
+	}
+	if strings.HasSuffix(name, ChunkIndexSuffix) {
+		verifyChunkedImage(ctx, run, chunks, name, art, report)
+		return
+	}
+	checkImage(dir, name, format, vsize, headerErr, art, report)
+}
+
+// verifyChunkedImage reassembles a deduplicated image from the chunk store, checking every chunk,
+// and checks the image against its chunk index and manifest entry.
+func verifyChunkedImage(ctx context.Context, run Sink, chunks *ChunkStore, name string, art *Artifact, report *VerifyReport) {
+	dir := run.String()
+	idx, err := readChunkIndex(ctx, run, name)
+	if err != nil {
+		report.add(dir, name, "%v", err)
+		return
+	}
+	hw := newHashingWriter()
+	image := &countingReader{r: io.TeeReader(newChunkedReader(ctx, chunks, idx), hw)}
+	vsize, headerErr, err := scanImage(image, idx.Format)
+	if err != nil {
+		report.add(dir, name, "%s: %v", chunks, err)
+		return
+	}
+	if sum := hw.Sum(); sum != idx.SHA256 {
+		report.add(dir, name, "reassembled image SHA-256 %s differs from index (%s)", sum, idx.SHA256)
+	}
+	if image.n != idx.Size {
+		report.add(dir, name, "reassembled image size %d differs from index (%d)", image.n, idx.Size)
+	}
+	if art != nil && art.UncompressedBytes > 0 && art.UncompressedBytes != image.n {
+		report.add(dir, name, "image size %d differs from %s (%d)", image.n, ManifestFile, art.UncompressedBytes)
+	}
+	checkImage(dir, name, idx.Format, vsize, headerErr, art, report)
+}
+
+// scanImage reads an image to the end, returning its virtual size from the header (for raw, its length).
+// headerErr reports an invalid header; err a read failure.
+func scanImage(image *countingReader, format string) (vsize int64, headerErr, err error) {
+	if SupportedDiskFormats[format] {
+		vsize, headerErr = ImageVirtualSize(image, format, 0)
+	}
+	if _, err := io.Copy(io.Discard, image); err != nil {
+		return 0, nil, err
+	}
+	if format == "raw" {
+		vsize = image.n
+	}
+	return vsize, headerErr, nil
+}
+
+// checkImage reports an invalid image header or a virtual size that differs from the source volume.
+func checkImage(dir, name, format string, vsize int64, headerErr error, art *Artifact, report *VerifyReport) {
+	if !SupportedDiskFormats[format] {
+		return
+	}
+	if headerErr != nil {
+		report.add(dir, name, "invalid %s image: %v", format, headerErr)
+		return
+	}
+	if art != nil && art.Volume != nil && art.Volume.SizeGB > 0 {
+		if want := int64(art.Volume.SizeGB) << 30; vsize != want {
+			report.add(dir, name, "virtual size %d differs from source volume size %d (%dGB)", vsize, want, art.Volume.SizeGB)
+		}
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}